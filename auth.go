@@ -0,0 +1,339 @@
+package drpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 认证分为两个阶段：
+// 1) 握手时，Authenticator 收到 Option.Metadata，serviceMethod 为空。返回 AuthInfo 表示
+//    整个连接通过了认证，之后的请求不再认证；返回 nil 表示交给每个请求自己认证；返回错误则拒绝连接。
+// 2) 连接没有在握手时通过认证时，每个请求都会带着自己的 Metadata 认证一次，失败时返回 Unauthenticated。
+// 客户端的 PerRPCCredentials 在握手和每个请求时都会被调用，serviceMethod 同样在握手时为空。
+
+// AuthInfo is what an Authenticator found out about the caller.
+// Handlers get it with AuthFromContext.
+type AuthInfo struct {
+	Subject string            // the identity of the caller, e.g. a user or a service name
+	Extra   map[string]string // anything else the Authenticator wants handlers to know
+}
+
+// Authenticator checks the credentials a client sends, see WithAuthenticator.
+type Authenticator interface {
+	// Authenticate is called with the metadata of the handshake and an empty
+	// serviceMethod, then, if that did not return an AuthInfo, with the metadata
+	// of every request. A nil AuthInfo with a nil error lets the caller through
+	// anonymously. ctx carries the Peer.
+	// Requests are authenticated on the read loop of their connection,
+	// before their body is decoded, so Authenticate should not block.
+	Authenticate(ctx context.Context, serviceMethod string, md Metadata) (*AuthInfo, error)
+}
+
+// PerRPCCredentials adds credentials to the metadata of the handshake
+// and of each call, see Option.PerRPCCredentials.
+type PerRPCCredentials interface {
+	// GetRequestMetadata returns the metadata to send with the call serviceMethod,
+	// or with the handshake if serviceMethod is empty.
+	GetRequestMetadata(ctx context.Context, serviceMethod string) (Metadata, error)
+}
+
+// WithAuthenticator makes the server authenticate its clients with a.
+func WithAuthenticator(a Authenticator) ServerOption {
+	return func(server *Server) {
+		server.auth = a
+	}
+}
+
+type authKey struct{}
+
+// AuthFromContext returns what the Authenticator found out about the caller
+// of the request handled with ctx.
+func AuthFromContext(ctx context.Context) (*AuthInfo, bool) {
+	info, ok := ctx.Value(authKey{}).(*AuthInfo)
+	return info, ok
+}
+
+// authenticateConn runs the Authenticator on the handshake.
+func (server *Server) authenticateConn(peer *Peer, opt *Option) (*AuthInfo, error) {
+	if server.auth == nil {
+		return nil, nil
+	}
+	ctx := context.Background()
+	if peer != nil {
+		ctx = context.WithValue(ctx, peerKey{}, peer)
+	}
+	info, err := server.auth.Authenticate(ctx, "", opt.Metadata)
+	if err != nil {
+		return nil, unauthenticated(err)
+	}
+	return info, nil
+}
+
+// authenticate runs the Authenticator on a request, unless its connection has
+// been authenticated already, and returns ctx with the AuthInfo.
+func (server *Server) authenticate(ctx context.Context, sc *serverConn, serviceMethod string) (context.Context, error) {
+	info := sc.auth
+	if info == nil && server.auth != nil {
+		md, _ := FromIncomingContext(ctx)
+		var err error
+		if info, err = server.auth.Authenticate(ctx, serviceMethod, md); err != nil {
+			return ctx, unauthenticated(err)
+		}
+	}
+	if info != nil {
+		ctx = context.WithValue(ctx, authKey{}, info)
+	}
+	return ctx, nil
+}
+
+// unauthenticated gives err the Unauthenticated code, unless it already has one.
+func unauthenticated(err error) error {
+	if CodeOf(err) != Unknown {
+		return err
+	}
+	return Errorf(Unauthenticated, "rpc server: %v", err)
+}
+
+// requestMetadata returns the metadata to send with call: the outgoing
+// metadata of its context plus the PerRPCCredentials of the client.
+func (c *Client) requestMetadata(call *Call) (Metadata, error) {
+	var md Metadata
+	ctx := context.Background()
+	if call.ctx != nil {
+		ctx = call.ctx
+		md, _ = FromOutgoingContext(ctx)
+	}
+	creds := c.opt.PerRPCCredentials
+	if creds == nil {
+		return md, nil
+	}
+	extra, err := creds.GetRequestMetadata(ctx, call.ServiceMethod)
+	if err != nil {
+		return nil, Errorf(Unauthenticated, "rpc client: get credentials: %v", err)
+	}
+	md = md.Copy()
+	if md == nil {
+		md = make(Metadata, len(extra))
+	}
+	for k, v := range extra {
+		md[k] = v
+	}
+	return md, nil
+}
+
+// handshakeOption returns the Option to send in the handshake,
+// with the credentials of opt.PerRPCCredentials added to its Metadata.
+func handshakeOption(opt *Option) (*Option, error) {
+	if opt.PerRPCCredentials == nil {
+		return opt, nil
+	}
+	extra, err := opt.PerRPCCredentials.GetRequestMetadata(context.Background(), "")
+	if err != nil {
+		return nil, Errorf(Unauthenticated, "rpc client: get credentials: %v", err)
+	}
+	o := *opt
+	o.Metadata = opt.Metadata.Copy()
+	if o.Metadata == nil {
+		o.Metadata = make(Metadata, len(extra))
+	}
+	for k, v := range extra {
+		o.Metadata[k] = v
+	}
+	return &o, nil
+}
+
+const authorizationKey = "authorization"
+
+// BearerToken sends a fixed token as "authorization: Bearer <token>".
+type BearerToken string
+
+func (t BearerToken) GetRequestMetadata(context.Context, string) (Metadata, error) {
+	return Pairs(authorizationKey, "Bearer "+string(t)), nil
+}
+
+// TokenAuthenticator checks the bearer token sent by BearerToken.
+// When the handshake carries no token, each request must carry one.
+type TokenAuthenticator func(ctx context.Context, token string) (*AuthInfo, error)
+
+func (f TokenAuthenticator) Authenticate(ctx context.Context, serviceMethod string, md Metadata) (*AuthInfo, error) {
+	const prefix = "Bearer "
+	v := md[authorizationKey]
+	if !strings.HasPrefix(v, prefix) {
+		if serviceMethod == "" {
+			return nil, nil
+		}
+		return nil, Errorf(Unauthenticated, "rpc server: missing bearer token")
+	}
+	return f(ctx, v[len(prefix):])
+}
+
+// StaticTokens returns a TokenAuthenticator that accepts the tokens
+// in tokens, each standing for the subject it maps to.
+func StaticTokens(tokens map[string]string) TokenAuthenticator {
+	return func(_ context.Context, token string) (*AuthInfo, error) {
+		for t, subject := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return &AuthInfo{Subject: subject}, nil
+			}
+		}
+		return nil, Errorf(Unauthenticated, "rpc server: invalid bearer token")
+	}
+}
+
+// HMAC 签名的内容为 "keyID\nserviceMethod\ntimestamp\nnonce"，签名随每个请求发送，
+// 因此请求无法被改投到其他方法；时间戳限制了签名的有效期，HMACAuthenticator 在有效期内
+// 记住用过的 nonce，同一个签名只能使用一次。
+// 认证在解码 body 之前进行，签名不覆盖请求的参数：截获请求的中间人可以在它到达服务端
+// 之前替换参数，需要保证参数完整时应该同时使用 TLS。
+const (
+	hmacKeyIDKey     = "x-drpc-hmac-key"
+	hmacTimestampKey = "x-drpc-hmac-timestamp"
+	hmacNonceKey     = "x-drpc-hmac-nonce"
+	hmacSignatureKey = "x-drpc-hmac-signature"
+
+	defaultHMACMaxSkew   = 5 * time.Minute
+	defaultHMACMaxNonces = 1 << 20
+	// nonceBucket 是 nonce 按过期时间分桶的粒度，整个桶过期后一起删除
+	nonceBucket = 10 * time.Second
+)
+
+func hmacSign(secret []byte, keyID, serviceMethod, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyID + "\n" + serviceMethod + "\n" + timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HMACCredentials signs each call with a secret shared with the server.
+// The signature covers the method, not the arguments, see HMACAuthenticator.
+type HMACCredentials struct {
+	KeyID  string // tells the server which secret to check the signature with
+	Secret []byte
+}
+
+func (c *HMACCredentials) GetRequestMetadata(_ context.Context, serviceMethod string) (Metadata, error) {
+	if serviceMethod == "" {
+		// 只签名请求，握手不携带凭证
+		return nil, nil
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(b[:])
+	return Pairs(
+		hmacKeyIDKey, c.KeyID,
+		hmacTimestampKey, ts,
+		hmacNonceKey, nonce,
+		hmacSignatureKey, hmacSign(c.Secret, c.KeyID, serviceMethod, ts, nonce),
+	), nil
+}
+
+// HMACAuthenticator checks the signatures made by HMACCredentials.
+// The subject of an authenticated caller is its key ID.
+// Each signature is accepted once. It authenticates the caller and the method
+// called, but not the arguments, which are decoded after authentication:
+// use TLS if they must not be tampered with.
+//
+// To reject replays it remembers every signature until it expires, that is
+// for about MaxSkew. A remembered signature takes about 100 bytes, so the
+// default MaxNonces of 1<<20 bounds the memory at about 100MB, and allows
+// about 3500 signed calls per second with the default MaxSkew. Once it is
+// reached, new signatures are refused with ResourceExhausted until old ones
+// expire: raise MaxNonces or lower MaxSkew for busier servers.
+type HMACAuthenticator struct {
+	Secrets   map[string][]byte // key ID -> secret
+	MaxSkew   time.Duration     // how old a signature may be, 5 minutes if 0
+	MaxNonces int               // how many signatures may be remembered, 1<<20 if 0
+
+	mu     sync.Mutex
+	nonces map[int64]map[string]struct{} // nonces seen, by the bucket of their expiry
+	count  int                           // nonces in all the buckets
+	pruned int64                         // the last bucket pruned
+}
+
+func (a *HMACAuthenticator) Authenticate(_ context.Context, serviceMethod string, md Metadata) (*AuthInfo, error) {
+	if serviceMethod == "" {
+		return nil, nil
+	}
+	keyID := md[hmacKeyIDKey]
+	secret, ok := a.Secrets[keyID]
+	if !ok {
+		return nil, Errorf(Unauthenticated, "rpc server: unknown hmac key %q", keyID)
+	}
+
+	ts := md[hmacTimestampKey]
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, Errorf(Unauthenticated, "rpc server: invalid hmac timestamp %q", ts)
+	}
+	maxSkew := a.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = defaultHMACMaxSkew
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > maxSkew || skew < -maxSkew {
+		return nil, Errorf(Unauthenticated, "rpc server: hmac signature expired")
+	}
+
+	nonce := md[hmacNonceKey]
+	if nonce == "" {
+		return nil, Errorf(Unauthenticated, "rpc server: missing hmac nonce")
+	}
+	want := hmacSign(secret, keyID, serviceMethod, ts, nonce)
+	if !hmac.Equal([]byte(want), []byte(md[hmacSignatureKey])) {
+		return nil, Errorf(Unauthenticated, "rpc server: invalid hmac signature")
+	}
+	if err := a.remember(keyID+"\n"+nonce, time.Unix(sec, 0).Add(maxSkew)); err != nil {
+		return nil, err
+	}
+	return &AuthInfo{Subject: keyID}, nil
+}
+
+// remember records nonce until expires, when the timestamp check rejects its
+// signature anyway. It fails if nonce was seen before, or if too many nonces
+// are remembered already.
+func (a *HMACAuthenticator) remember(nonce string, expires time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.nonces == nil {
+		a.nonces = make(map[int64]map[string]struct{})
+	}
+	// 桶的结束时间早于现在时，其中所有的签名都已经过期
+	if now := int64(time.Now().UnixNano() / int64(nonceBucket)); now > a.pruned {
+		for b, set := range a.nonces {
+			if b < now {
+				a.count -= len(set)
+				delete(a.nonces, b)
+			}
+		}
+		a.pruned = now
+	}
+
+	// 重放的签名带着相同的时间戳，因此落在同一个桶中
+	b := expires.UnixNano() / int64(nonceBucket)
+	set := a.nonces[b]
+	if _, ok := set[nonce]; ok {
+		return Errorf(Unauthenticated, "rpc server: hmac signature already used")
+	}
+	limit := a.MaxNonces
+	if limit <= 0 {
+		limit = defaultHMACMaxNonces
+	}
+	if a.count >= limit {
+		return Errorf(ResourceExhausted, "rpc server: too many hmac signatures to remember")
+	}
+	if set == nil {
+		set = make(map[string]struct{})
+		a.nonces[b] = set
+	}
+	set[nonce] = struct{}{}
+	a.count++
+	return nil
+}
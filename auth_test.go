@@ -0,0 +1,101 @@
+package drpc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type Whoami struct{}
+
+func (Whoami) Subject(ctx context.Context, _ int, reply *string) error {
+	info, ok := AuthFromContext(ctx)
+	if !ok {
+		return Errorf(Unauthenticated, "anonymous")
+	}
+	*reply = info.Subject
+	return nil
+}
+
+func startAuthServer(t *testing.T, a Authenticator) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	server := NewServer(WithAuthenticator(a))
+	_ = server.Register(Whoami{})
+	go server.Accept(l)
+	return l.Addr().String(), func() { _ = server.Close() }
+}
+
+func TestServer_BearerToken(t *testing.T) {
+	addr, stop := startAuthServer(t, StaticTokens(map[string]string{"s3cret": "alice"}))
+	defer stop()
+
+	client, err := Dial("tcp", addr, &Option{PerRPCCredentials: BearerToken("s3cret")})
+	assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	var subject string
+	err = client.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	assert(err == nil && subject == "alice", "expect subject alice, got %q: %v", subject, err)
+
+	// 握手时没有凭证的连接可以建立，但每个请求都需要认证
+	anonymous, err := Dial("tcp", addr)
+	assert(err == nil, "dial error: %v", err)
+	defer func() { _ = anonymous.Close() }()
+	err = anonymous.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+
+	_, err = Dial("tcp", addr, &Option{PerRPCCredentials: BearerToken("wrong")})
+	assert(err != nil, "expect a wrong token to be rejected at the handshake")
+}
+
+func TestServer_HMAC(t *testing.T) {
+	addr, stop := startAuthServer(t, &HMACAuthenticator{
+		Secrets: map[string][]byte{"billing": []byte("k3y")},
+	})
+	defer stop()
+
+	client, err := Dial("tcp", addr, &Option{
+		PerRPCCredentials: &HMACCredentials{KeyID: "billing", Secret: []byte("k3y")},
+	})
+	assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	var subject string
+	err = client.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	assert(err == nil && subject == "billing", "expect subject billing, got %q: %v", subject, err)
+
+	forged, err := Dial("tcp", addr, &Option{
+		PerRPCCredentials: &HMACCredentials{KeyID: "billing", Secret: []byte("guess")},
+	})
+	assert(err == nil, "dial error: %v", err)
+	defer func() { _ = forged.Close() }()
+	err = forged.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+}
+
+func TestHMACAuthenticator_Replay(t *testing.T) {
+	a := &HMACAuthenticator{Secrets: map[string][]byte{"billing": []byte("k3y")}}
+	creds := &HMACCredentials{KeyID: "billing", Secret: []byte("k3y")}
+	md, err := creds.GetRequestMetadata(context.Background(), "Whoami.Subject")
+	assert(err == nil, "sign error: %v", err)
+
+	_, err = a.Authenticate(context.Background(), "Whoami.Subject", md)
+	assert(err == nil, "expect the signature to be accepted, got %v", err)
+	_, err = a.Authenticate(context.Background(), "Whoami.Subject", md)
+	assert(CodeOf(err) == Unauthenticated, "expect a replayed signature to be rejected, got %v", err)
+
+	md, _ = creds.GetRequestMetadata(context.Background(), "Whoami.Subject")
+	_, err = a.Authenticate(context.Background(), "Whoami.Subject", md)
+	assert(err == nil, "expect a new signature to be accepted, got %v", err)
+
+	// 记住的签名数量有上限，超过时拒绝新的签名而不是忘记旧的
+	a.MaxNonces = 2
+	md, _ = creds.GetRequestMetadata(context.Background(), "Whoami.Subject")
+	_, err = a.Authenticate(context.Background(), "Whoami.Subject", md)
+	assert(CodeOf(err) == ResourceExhausted, "expect the signature to be refused when full, got %v", err)
+
+	// 过期的签名连同它们的桶一起被删除
+	a.nonces = map[int64]map[string]struct{}{0: {"old": {}, "older": {}}}
+	a.count, a.pruned = 2, 0
+	_, err = a.Authenticate(context.Background(), "Whoami.Subject", md)
+	assert(err == nil && a.count == 1, "expect expired signatures to be forgotten, got %d: %v", a.count, err)
+}
@@ -0,0 +1,179 @@
+package drpc
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 鉴权发生在认证之后、查找服务方法之前，被拒绝的请求返回 PermissionDenied。
+// 调用方的身份来自 AuthFromContext，没有 Authenticator 时也可以是 mutual TLS 的客户端证书。
+
+// DebugServiceMethod is the name the debug HTTP handler is authorized as,
+// so that a Policy can say who may see it.
+const DebugServiceMethod = "drpc.Debug"
+
+// Authorizer decides who may call which Service.Method, see WithAuthorizer.
+type Authorizer interface {
+	// Authorize returns nil if the caller of ctx may call serviceMethod.
+	// ctx carries the Peer and the AuthInfo, if any. Like Authenticate,
+	// it runs on the read loop of the connection and should not block.
+	Authorize(ctx context.Context, serviceMethod string) error
+}
+
+// WithAuthorizer makes the server check every call, and the debug HTTP
+// handler, with a.
+func WithAuthorizer(a Authorizer) ServerOption {
+	return func(server *Server) {
+		server.authz = a
+	}
+}
+
+// authorize runs the Authorizer on a request.
+func (server *Server) authorize(ctx context.Context, serviceMethod string) error {
+	if server.authz == nil {
+		return nil
+	}
+	if err := server.authz.Authorize(ctx, serviceMethod); err != nil {
+		if CodeOf(err) != Unknown {
+			return err
+		}
+		return Errorf(PermissionDenied, "rpc server: %v", err)
+	}
+	return nil
+}
+
+// authorizeHTTP authenticates and authorizes a request to the debug handler.
+// The HTTP headers, with lower case names, are the Metadata of the request.
+func (server *Server) authorizeHTTP(req *http.Request) error {
+	if server.authz == nil {
+		return nil
+	}
+	ctx := context.WithValue(req.Context(), peerKey{}, &Peer{TLS: req.TLS})
+	if server.auth != nil {
+		md := make(Metadata, len(req.Header))
+		for k, v := range req.Header {
+			md[strings.ToLower(k)] = v[0]
+		}
+		info, err := server.auth.Authenticate(ctx, DebugServiceMethod, md)
+		if err != nil {
+			return unauthenticated(err)
+		}
+		if info != nil {
+			ctx = context.WithValue(ctx, authKey{}, info)
+		}
+	}
+	return server.authorize(ctx, DebugServiceMethod)
+}
+
+// PolicyRule lets the listed subjects call the methods matched by Method.
+type PolicyRule struct {
+	// Method is "Service.Method", "Service.*" or "*".
+	Method string `json:"method" yaml:"method"`
+	// Allow lists the subjects that may call Method. "*" is anybody,
+	// including anonymous callers.
+	Allow []string `json:"allow" yaml:"allow"`
+}
+
+// Policy is an Authorizer made of rules. The most specific rule matching a
+// method decides: "Service.Method" before "Service.*" before "*". Methods
+// no rule matches are denied.
+//
+// The subject of a caller is the Subject of its AuthInfo or, if it has none,
+// the common name of its client certificate.
+//
+// A Policy can be loaded from a YAML or JSON file, see LoadPolicy:
+//
+//	rules:
+//	  - method: Arith.*
+//	    allow: [alice, bob]
+//	  - method: drpc.Debug
+//	    allow: [admin]
+type Policy struct {
+	mu    sync.RWMutex
+	rules map[string]map[string]bool // method pattern -> allowed subjects
+}
+
+// NewPolicy returns a Policy with the given rules.
+func NewPolicy(rules ...PolicyRule) *Policy {
+	p := &Policy{rules: make(map[string]map[string]bool)}
+	for _, r := range rules {
+		p.Allow(r.Method, r.Allow...)
+	}
+	return p
+}
+
+// LoadPolicy reads a Policy from a YAML or JSON file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses a Policy written in YAML or JSON, see Policy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	// JSON 是 YAML 的子集，yaml.v3 可以同时解析两种格式
+	var file struct {
+		Rules []PolicyRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return NewPolicy(file.Rules...), nil
+}
+
+// Allow lets subjects call the methods matched by method, in addition
+// to the subjects already allowed. It is safe to call while serving.
+func (p *Policy) Allow(method string, subjects ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	allowed := p.rules[method]
+	if allowed == nil {
+		allowed = make(map[string]bool, len(subjects))
+		p.rules[method] = allowed
+	}
+	for _, s := range subjects {
+		allowed[s] = true
+	}
+}
+
+func (p *Policy) Authorize(ctx context.Context, serviceMethod string) error {
+	subject := subjectOf(ctx)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	allowed, ok := p.rules[serviceMethod]
+	if dot := strings.LastIndex(serviceMethod, "."); !ok && dot >= 0 {
+		allowed, ok = p.rules[serviceMethod[:dot]+".*"]
+	}
+	if !ok {
+		allowed = p.rules["*"]
+	}
+	if allowed["*"] || (subject != "" && allowed[subject]) {
+		return nil
+	}
+
+	if subject == "" {
+		subject = "anonymous caller"
+	}
+	return Errorf(PermissionDenied, "rpc server: %s may not call %s", subject, serviceMethod)
+}
+
+// subjectOf returns who the caller of ctx is, "" if anonymous.
+func subjectOf(ctx context.Context) string {
+	if info, ok := AuthFromContext(ctx); ok && info.Subject != "" {
+		return info.Subject
+	}
+	if p, ok := PeerFromContext(ctx); ok {
+		if cert := p.Certificate(); cert != nil {
+			return cert.Subject.CommonName
+		}
+	}
+	return ""
+}
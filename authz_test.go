@@ -0,0 +1,95 @@
+package drpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+rules:
+  - method: Whoami.*
+    allow: [alice, bob]
+  - method: Whoami.Subject
+    allow: [alice]
+  - method: "*"
+    allow: [admin]
+`))
+	assert(err == nil, "parse error: %v", err)
+	as := func(subject string) context.Context {
+		return context.WithValue(context.Background(), authKey{}, &AuthInfo{Subject: subject})
+	}
+
+	cases := []struct {
+		ctx    context.Context
+		method string
+		ok     bool
+	}{
+		{as("alice"), "Whoami.Subject", true},
+		{as("bob"), "Whoami.Subject", false}, // 具体方法的规则优先于 Service.*
+		{as("bob"), "Whoami.Other", true},
+		{as("admin"), "Whoami.Other", false},
+		{as("admin"), "Arith.Sum", true},
+		{context.Background(), "Arith.Sum", false},
+	}
+	for _, c := range cases {
+		err := policy.Authorize(c.ctx, c.method)
+		assert((err == nil) == c.ok, "%s: expect allowed=%v, got %v", c.method, c.ok, err)
+		assert(err == nil || CodeOf(err) == PermissionDenied, "expect PermissionDenied, got %v", err)
+	}
+
+	// JSON 同样可以解析
+	policy, err = ParsePolicy([]byte(`{"rules": [{"method": "*", "allow": ["*"]}]}`))
+	assert(err == nil, "parse error: %v", err)
+	err = policy.Authorize(context.Background(), "Arith.Sum")
+	assert(err == nil, "expect anybody to be allowed, got %v", err)
+}
+
+func TestServer_Authorizer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	server := NewServer(
+		WithAuthenticator(StaticTokens(map[string]string{"a": "alice", "b": "bob", "r": "root"})),
+		WithAuthorizer(NewPolicy(
+			PolicyRule{Method: "Whoami.Subject", Allow: []string{"alice"}},
+			PolicyRule{Method: DebugServiceMethod, Allow: []string{"root"}},
+		)),
+	)
+	_ = server.Register(Whoami{})
+	go server.Accept(l)
+	defer func() { _ = server.Close() }()
+
+	dial := func(token string) *Client {
+		client, err := Dial("tcp", l.Addr().String(), &Option{PerRPCCredentials: BearerToken(token)})
+		assert(err == nil, "dial error: %v", err)
+		return client
+	}
+	alice, bob := dial("a"), dial("b")
+	defer func() { _ = alice.Close() }()
+	defer func() { _ = bob.Close() }()
+
+	var subject string
+	err = alice.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	assert(err == nil && subject == "alice", "expect alice to be allowed, got %q: %v", subject, err)
+	err = bob.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	assert(CodeOf(err) == PermissionDenied, "expect PermissionDenied, got %v", err)
+	// 没有权限的调用方无法知道方法是否存在
+	err = bob.Call(context.Background(), "Whoami.Missing", 0, &subject)
+	assert(CodeOf(err) == PermissionDenied, "expect PermissionDenied, got %v", err)
+
+	debug := debugHTTP{server}
+	for token, want := range map[string]int{
+		"r":     http.StatusOK,
+		"a":     http.StatusForbidden,
+		"wrong": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest("GET", defaultDebugPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		debug.ServeHTTP(w, req)
+		assert(w.Code == want, "token %q: expect status %d, got %d", token, want, w.Code)
+	}
+}
@@ -24,9 +24,17 @@ type Call struct {
 	Reply         interface{}
 	Error         error
 	Done          chan *Call
+	Trailer       Metadata // trailer set by the handler, see SetTrailer
+
+	ctx    context.Context // carries the deadline sent to the server, nil for Go
+	stream *ClientStream   // non-nil for streaming calls
 }
 
 func (c *Call) done() {
+	if c.stream != nil {
+		// 流在已收到的消息都被取走之后结束
+		c.stream.recv.finish(c.Error)
+	}
 	c.Done <- c
 }
 
@@ -46,33 +54,60 @@ type Client struct {
 	seq     uint64
 	pending map[uint64]*Call
 
-	closing  bool
-	shutdown bool
+	closing   bool
+	shutdown  bool
+	goingAway bool // 服务端发来了 GOAWAY，不再发送新的请求
+
+	interceptors []ClientInterceptor
+
+	// 流量控制，见 stream.go
+	streamWindow uint32
+	recvWindow   *recvWindow // 连接的接收窗口
+	quota        *sendQuota  // 连接的发送额度
 }
 
 var ErrShutdown = errors.New("connection is shut down")
 
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	codecFunc := codec.NewCodecFuncMap[opt.CodecType]
-	if codecFunc == nil {
+	hsOpt, err := handshakeOption(opt)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if m, ok := codec.LookupMarshaler(opt.CodecType); ok && !opt.JSONHandshake {
+		if err := clientHandshake(conn, hsOpt); err != nil {
+			log.Println("rpc client: handshake error:", err)
+			_ = conn.Close()
+			return nil, err
+		}
+		return newClientWithCodec(codec.NewFrameCodec(conn, m), opt), nil
+	}
+
+	codecFunc, ok := codec.Lookup(opt.CodecType)
+	if !ok {
 		err := fmt.Errorf("invalid codec type: %s", opt.CodecType)
 		log.Println("rpc client: invalid codec type:", opt.CodecType)
 		return nil, err
 	}
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println()
+	if err := json.NewEncoder(conn).Encode(hsOpt); err != nil {
+		log.Println("rpc client: options error:", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientWithCodec(codecFunc(conn), opt), nil
+	return newClientWithCodec(newLegacyCodec(codecFunc, conn, conn), opt), nil
 }
 
 func newClientWithCodec(cc codec.Codec, opt *Option) *Client {
+	setMsgSizeLimits(cc, opt.MaxRecvMsgSize, opt.MaxSendMsgSize)
+	streamWindow, connWindow := opt.windows()
 	client := &Client{
-		cc:      cc,
-		opt:     opt,
-		seq:     1,
-		pending: make(map[uint64]*Call),
+		cc:           cc,
+		opt:          opt,
+		seq:          1,
+		pending:      make(map[uint64]*Call),
+		streamWindow: streamWindow,
+		recvWindow:   newRecvWindow(connWindow),
+		quota:        newSendQuota(connWindow),
 	}
 	go client.receive()
 	return client
@@ -92,13 +127,30 @@ func (c *Client) Close() error {
 func (c *Client) IsAvailable() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return !c.shutdown && !c.closing
+	return !c.shutdown && !c.closing && !c.goingAway
+}
+
+// GoingAway reports whether the server asked the client to stop sending
+// new calls because it is shutting down. Pending calls still complete,
+// and the server closes the connection once they have.
+func (c *Client) GoingAway() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.goingAway
+}
+
+// ActiveRequests returns the number of calls and streams waiting for their
+// reply, which load balancers use to tell how busy the server is.
+func (c *Client) ActiveRequests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
 }
 
 func (c *Client) registerCall(call *Call) (uint64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.closing || c.shutdown {
+	if c.closing || c.shutdown || c.goingAway {
 		return 0, ErrShutdown
 	}
 	call.Seq = c.seq
@@ -118,6 +170,13 @@ func (c *Client) removeCall(seq uint64) (call *Call) {
 	return
 }
 
+// pendingCall returns the call seq without removing it, used for stream messages.
+func (c *Client) pendingCall(seq uint64) *Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending[seq]
+}
+
 // 当服务端或者客户端发生错误的时候，终止队列中的所有Call
 func (c *Client) terminateCalls(err error) {
 	c.sending.Lock()
@@ -135,62 +194,183 @@ func (c *Client) receive() {
 	var err error
 	for err == nil {
 		var h codec.Header
-		if err := c.cc.ReadHeader(&h); err != nil {
+		if err = c.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		if h.Kind == codec.KindGoAway {
+			c.mu.Lock()
+			c.goingAway = true
+			c.mu.Unlock()
+			err = c.discardBody()
+			continue
+		}
+		if h.Kind == codec.KindStream || h.Kind == codec.KindWindowUpdate {
+			err = c.receiveStream(&h)
+			continue
+		}
 		call := c.removeCall(h.Seq)
-		switch {
+		if call != nil {
+			call.Trailer = h.Metadata
+			if call.stream != nil {
+				// 流已经结束，还没被取走的消息不再占用连接的额度
+				if n := call.stream.recv.release(); n > 0 {
+					go c.sendWindowUpdate(0, windowUpdate{conn: n})
+				}
+			}
+		}
+		switch status := headerStatus(&h); {
 		case call == nil:
-			err = c.cc.ReadBody(nil)
-		case h.Error != "":
-			call.Error = errors.New(h.Error)
-			err = c.cc.ReadBody(nil)
+			err = c.discardBody()
+		case status != nil:
+			call.Error = status
+			err = c.discardBody()
 			call.done()
 		default:
 			err = c.cc.ReadBody(call.Reply)
-			if err != nil {
-				call.Error = errors.New("rpc client: reading body: " + err.Error())
+			if isMsgSizeError(err) {
+				// 过大的回复已经被跳过，只有这个请求失败
+				call.Error, err = StatusOf(err), nil
+			} else if err != nil {
+				call.Error = Errorf(Internal, "rpc client: reading body: %v", err)
 			}
 			call.done()
 		}
 	}
 	// errors occurs, so terminateCalls pending calls.
 	c.terminateCalls(err)
+	if c.GoingAway() {
+		// 服务端处理完剩余请求后关闭了连接，客户端这一侧也随之关闭
+		_ = c.cc.Close()
+	}
+}
+
+// discardBody skips the body of a message nobody waits for.
+// A body over MaxRecvMsgSize has been skipped as well, so it is not an error.
+func (c *Client) discardBody() error {
+	if err := c.cc.ReadBody(nil); !isMsgSizeError(err) {
+		return err
+	}
+	return nil
+}
+
+// receiveStream hands a stream message to its ClientStream without decoding it,
+// or returns the credit carried by a window update to the stream or the connection.
+func (c *Client) receiveStream(h *codec.Header) error {
+	if h.Kind == codec.KindWindowUpdate {
+		if h.Seq == 0 {
+			c.quota.add(h.Window)
+		} else if call := c.pendingCall(h.Seq); call != nil && call.stream != nil {
+			call.stream.quota.add(h.Window)
+		}
+		return c.discardBody()
+	}
+
+	if !c.recvWindow.receive() {
+		return Errorf(ResourceExhausted, "rpc client: connection window exceeded")
+	}
+	call := c.pendingCall(h.Seq)
+	if call == nil || call.stream == nil {
+		// 流已经结束，丢弃消息并归还连接的额度
+		c.dropped()
+		return c.discardBody()
+	}
+	data, err := call.stream.raw.ReadRawBody()
+	if isMsgSizeError(err) {
+		// 过大的消息已经被跳过，只有这个流失败
+		c.dropped()
+		_ = call.stream.fail(StatusOf(err))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !call.stream.recv.win.receive() {
+		// 服务端超出了流的窗口，只有这个流失败
+		c.dropped()
+		_ = call.stream.fail(Errorf(ResourceExhausted, "rpc client: stream window exceeded"))
+		return nil
+	}
+	if !call.stream.recv.push(data) {
+		c.dropped()
+	}
+	return nil
+}
+
+// dropped gives back the connection credit of a stream message nobody will
+// receive. It runs on the receiving goroutine, so it must not block on sending.
+func (c *Client) dropped() {
+	if n := c.recvWindow.consume(1); n > 0 {
+		go c.sendWindowUpdate(0, windowUpdate{conn: n})
+	}
 }
 
 // Call 是客户端暴露给用户的RPC服务调用接口，它是对 Go 的封装。
 // 阻塞等待call.Done()，等待响应返回，是一个同步接口
 // Client.Call 的超时处理机制，使用 context 包实现，控制权交给用户，控制更为灵活。
 func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := c.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	invoker, _ := c.chain()
+	return invoker(ctx, serviceMethod, args, reply)
+}
+
+// invoke 是拦截器链最内层的 Invoker，真正地发送请求并等待响应
+func (c *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := c.newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	call.ctx = ctx
+	c.send(call)
 	select {
 	case <-ctx.Done():
-		c.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if c.removeCall(call.Seq) != nil {
+			// 通知服务端放弃这个请求，不阻塞调用方
+			go c.sendCancel(call.Seq)
+		}
+		return &Status{Code: StatusOf(ctx.Err()).Code, Message: "rpc client: call failed: " + ctx.Err().Error()}
 	case call := <-call.Done:
+		captureTrailer(ctx, call.Trailer)
 		return call.Error
 	}
 }
 
 // Go 是客户端暴露给用户的RPC服务调用接口，与 Call 不同的是，
 // Go 是一个异步接口，它返回一个Call实例
+// 存在拦截器时，请求在新的协程中经过拦截器链发出，此时 Call.Seq 不会被设置。
 func (c *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		log.Panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	call := c.newCall(serviceMethod, args, reply, done)
+
+	invoker, intercepted := c.chain()
+	if !intercepted {
+		c.send(call)
+		return call
+	}
+	go func() {
+		call.Error = invoker(context.Background(), serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+func (c *Client) newCall(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
-	c.send(call)
-	return call
 }
 
 func (c *Client) send(call *Call) {
+	// 凭证可能需要网络请求，在加锁之前获取
+	md, err := c.requestMetadata(call)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+
 	c.sending.Lock()
 	defer c.sending.Unlock()
 
@@ -205,6 +385,17 @@ func (c *Client) send(call *Call) {
 	c.header.ServiceMethod = call.ServiceMethod
 	c.header.Seq = seq
 	c.header.Error = ""
+	c.header.Timeout = 0
+	c.header.Metadata = md
+	if call.ctx != nil {
+		if deadline, ok := call.ctx.Deadline(); ok {
+			// 发送时剩余的时间，已经过期的请求也至少给服务端 1ns
+			c.header.Timeout = time.Until(deadline)
+			if c.header.Timeout <= 0 {
+				c.header.Timeout = 1
+			}
+		}
+	}
 
 	// encode and send the request
 	if err := c.cc.Write(&c.header, call.Args); err != nil {
@@ -212,12 +403,58 @@ func (c *Client) send(call *Call) {
 		// call may be is nil, it usually means that Write method
 		// partially failed, client has received the response and handled
 		if call != nil {
+			if isMsgSizeError(err) {
+				// 过大的请求没有写入任何数据，连接仍然可用
+				err = StatusOf(err)
+			}
 			call.Error = err
 			call.done()
 		}
 	}
 }
 
+// sendCancel tells the server that nobody waits for the call seq any more.
+func (c *Client) sendCancel(seq uint64) {
+	c.sendControl(&codec.Header{Seq: seq, Kind: codec.KindCancel})
+}
+
+// sendControl sends a message that carries no body, such as a cancel or a window update.
+func (c *Client) sendControl(h *codec.Header) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	// 收到 GOAWAY 之后已有的请求仍在进行，控制消息照常发送
+	c.mu.Lock()
+	closed := c.closing || c.shutdown
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	if err := c.cc.Write(h, struct{}{}); err != nil {
+		log.Println("rpc client: send control message error:", err)
+	}
+}
+
+// sendWindowUpdate gives the credit in update back to the server.
+func (c *Client) sendWindowUpdate(seq uint64, update windowUpdate) {
+	if update.stream > 0 {
+		c.sendControl(&codec.Header{Seq: seq, Kind: codec.KindWindowUpdate, Window: update.stream})
+	}
+	if update.conn > 0 {
+		c.sendControl(&codec.Header{Kind: codec.KindWindowUpdate, Window: update.conn})
+	}
+}
+
+// sendStream sends a message on the stream opened by the call h.Seq.
+// It returns io.EOF if the call has already finished.
+func (c *Client) sendStream(h *codec.Header, body interface{}) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if c.pendingCall(h.Seq) == nil {
+		return io.EOF
+	}
+	return c.cc.Write(h, body)
+}
+
 // Dial connects to an RPC server at the specified network address
 func Dial(network, addr string, opts ...*Option) (client *Client, err error) {
 	return dialTimeout(NewClient, network, addr, opts...)
@@ -281,7 +518,9 @@ func parseOptions(opts ...*Option) (*Option, error) {
 	if len(opts) > 1 {
 		return nil, errors.New("number of option is more than 1")
 	}
-	opt := opts[0]
+	// 复制一份，同一个 Option 可能被多个连接同时使用
+	o := *opts[0]
+	opt := &o
 	opt.MagicNumber = DefaultOption.MagicNumber
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
@@ -320,7 +559,8 @@ func DialHTTP(network, addr string, opts ...*Option) (*Client, error) {
 // XDial calls different functions to connect to a RPC server
 // according the first parameter rpcAddr.
 // rpcAddr is a general format (protocol@addr) to represent a rpc server
-// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/drpc.sock
+// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/drpc.sock, tls@10.0.0.1:9443
+// tls uses Option.TLSConfig.
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -331,6 +571,12 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		opt, err := parseOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+		return DialTLS("tcp", addr, opt.TLSConfig, opt)
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
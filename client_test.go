@@ -2,13 +2,17 @@ package drpc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/devhg/drpc/codec"
 )
 
 // func assert(condition bool, msg string, v ...interface{}) {
@@ -69,7 +73,8 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
@@ -95,7 +100,8 @@ func TestXDial(t *testing.T) {
 			_ = os.Remove(addr)
 			l, err := net.Listen("unix", addr)
 			if err != nil {
-				t.Fatal("failed to listen unix socket")
+				t.Error("failed to listen unix socket")
+				return
 			}
 			ch <- struct{}{}
 			Accept(l)
@@ -105,3 +111,124 @@ func TestXDial(t *testing.T) {
 		assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_Handshake(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	opts := map[string]*Option{
+		"framed gob":  {CodecType: codec.GobType},
+		"framed json": {CodecType: codec.JSONType},
+		"legacy gob":  {CodecType: codec.GobType, JSONHandshake: true},
+		"legacy json": {CodecType: codec.JSONType, JSONHandshake: true},
+	}
+	for name, opt := range opts {
+		opt := opt
+		t.Run(name, func(t *testing.T) {
+			client, err := Dial("tcp", l.Addr().String(), opt)
+			assert(err == nil, "dial error: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply int
+			err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+			assert(err == nil && reply == 3, "call Foo.Sum failed: %v", err)
+		})
+	}
+
+	t.Run("invalid codec", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		err := clientHandshake(conn, &Option{MagicNumber: MagicNumber, CodecType: "application/unknown"})
+		assert(err != nil && strings.Contains(err.Error(), "invalid codec type"), "expect handshake to be rejected")
+	})
+
+	t.Run("oversized option", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		_ = writePreamble(conn, ProtocolVersion)
+		_, _ = conn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert(err == io.EOF, "expect the server to hang up, got %v", err)
+	})
+
+	t.Run("oversized legacy option", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		go func() {
+			_, _ = conn.Write([]byte(`{"CodecType":"` + strings.Repeat("x", maxHandshakeFrame)))
+		}()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert(err != nil && !os.IsTimeout(err), "expect the server to hang up, got %v", err)
+	})
+
+	t.Run("legacy split newline", func(t *testing.T) {
+		// Option 之后的换行符单独到达，仍然不属于 codec 的数据
+		got := make(chan byte, 1)
+		typ := codec.Type(fmt.Sprintf("application/x-first-byte-%d", time.Now().UnixNano()))
+		_ = codec.Register(typ, func(conn io.ReadWriteCloser) codec.Codec {
+			return &firstByteCodec{conn, got}
+		})
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		data, _ := json.Marshal(&Option{MagicNumber: MagicNumber, CodecType: typ})
+		_, _ = conn.Write(data)
+		time.Sleep(20 * time.Millisecond)
+		_, _ = conn.Write([]byte("\nx"))
+		select {
+		case b := <-got:
+			assert(b == 'x', "expect the newline to be dropped, got %q", b)
+		case <-time.After(time.Second):
+			t.Fatal("expect the codec to read its first byte")
+		}
+	})
+}
+
+// firstByteCodec reports the first byte of its stream and stops.
+type firstByteCodec struct {
+	conn io.ReadWriteCloser
+	got  chan byte
+}
+
+func (c *firstByteCodec) ReadHeader(*codec.Header) error {
+	var b [1]byte
+	if _, err := io.ReadFull(c.conn, b[:]); err != nil {
+		return err
+	}
+	c.got <- b[0]
+	return io.EOF
+}
+
+func (c *firstByteCodec) ReadBody(interface{}) error             { return nil }
+func (c *firstByteCodec) Write(*codec.Header, interface{}) error { return nil }
+func (c *firstByteCodec) Close() error                           { return c.conn.Close() }
+
+func TestClient_Use(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	client := startTestServer(t, server)
+
+	var seen []error
+	client.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		// route the deprecated name to the new one
+		if serviceMethod == "Foo.Add" {
+			serviceMethod = "Foo.Sum"
+		}
+		err := invoker(ctx, serviceMethod, args, reply)
+		seen = append(seen, err)
+		return err
+	})
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Add", &Args{Num1: 1, Num2: 2}, &reply)
+	assert(err == nil && reply == 3, "expect rewritten call to succeed, got %d: %v", reply, err)
+
+	call := <-client.Go("Foo.Missing", &Args{}, &reply, nil).Done
+	assert(call.Error != nil, "expect an error from unknown method")
+	assert(len(seen) == 2 && seen[1] == call.Error, "expect interceptor to observe both calls")
+}
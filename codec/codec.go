@@ -1,11 +1,43 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kind tells the receiver what a message is for.
+type Kind uint8
+
+const (
+	KindCall         Kind = iota // a request, or the response to it
+	KindCancel                   // the client no longer waits for the call with the same Seq
+	KindGoAway                   // the server is shutting down, the client must not send new calls
+	KindStream                   // one message of the stream opened by the call with the same Seq
+	KindWindowUpdate             // the sender may send Window more messages on the stream with the same Seq
+)
 
 type Header struct {
-	ServiceMethod string // format "Service.Method"
-	Seq           uint64 // sequence number chosen by client
-	Error         string
+	ServiceMethod string   // format "Service.Method"
+	Seq           uint64   // sequence number chosen by client
+	Error         string   // error message, empty if the call succeeded
+	Code          uint32   // error code, see drpc.Code
+	Details       []string // optional error details
+	Kind          Kind
+
+	// Metadata holds the caller's metadata in a request and the handler's trailer in a response.
+	Metadata map[string]string
+
+	// Timeout is what remains of the client's deadline when the request is sent,
+	// 0 means no deadline. It is relative so that clock skew between peers does not matter.
+	Timeout time.Duration
+
+	// EndStream marks a KindStream message that carries no body and tells the
+	// server the client will send nothing more on the stream.
+	EndStream bool
+	// Window is the credit returned by a KindWindowUpdate message.
+	Window uint32
 }
 
 type NewCodecFunc func(closer io.ReadWriteCloser) Codec
@@ -13,13 +45,59 @@ type NewCodecFunc func(closer io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JSONType Type = "application/json"
+	GobType      Type = "application/gob"
+	JSONType     Type = "application/json"
+	ProtobufType Type = "application/protobuf"
 )
 
-var NewCodecFuncMap map[Type]NewCodecFunc
+// codecs 保存所有已注册的编解码器，读写都需要经过 codecsMu
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[Type]NewCodecFunc)
+)
+
+// NewCodecFuncMap holds the codecs by type, as before Register existed.
+// Register keeps it up to date and Lookup falls back to it, so codecs added
+// to it directly during init still work.
+//
+// Deprecated: use Register and Lookup, which are safe for concurrent use.
+// NewCodecFuncMap will be removed in the next release.
+var NewCodecFuncMap = make(map[Type]NewCodecFunc)
+
+// Register makes a codec available under the given type.
+// It returns an error if the type is empty, f is nil,
+// or a codec has already been registered for the type.
+func Register(typ Type, f NewCodecFunc) error {
+	if typ == "" {
+		return errors.New("rpc codec: register with empty codec type")
+	}
+	if f == nil {
+		return errors.New("rpc codec: register nil codec func for " + string(typ))
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[typ]; dup {
+		return errors.New("rpc codec: codec already registered: " + string(typ))
+	}
+	codecs[typ] = f
+	NewCodecFuncMap[typ] = f
+	return nil
+}
+
+// Lookup returns the codec registered for the given type.
+func Lookup(typ Type) (NewCodecFunc, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if f, ok := codecs[typ]; ok {
+		return f, true
+	}
+	f, ok := NewCodecFuncMap[typ]
+	return f, ok && f != nil
+}
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
+	_ = Register(GobType, NewGobCodec)
+	_ = Register(JSONType, NewJSONCodec)
+	_ = Register(ProtobufType, NewProtobufCodec)
 }
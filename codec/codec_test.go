@@ -0,0 +1,243 @@
+package codec
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type args struct {
+	Num1, Num2 int
+}
+
+func TestJSONCodec(t *testing.T) {
+	client, server := net.Pipe()
+	cc, sc := NewJSONCodec(client), NewJSONCodec(server)
+	defer func() { _ = cc.Close() }()
+
+	go func() {
+		_ = cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &args{1, 2})
+		_ = cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &args{3, 4})
+	}()
+
+	var h Header
+	var a args
+	if err := sc.ReadHeader(&h); err != nil || h.ServiceMethod != "Foo.Sum" || h.Seq != 1 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	// a nil body is discarded
+	if err := sc.ReadBody(nil); err != nil {
+		t.Fatal("discard body:", err)
+	}
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(&a); err != nil || a.Num1 != 3 || a.Num2 != 4 {
+		t.Fatalf("unexpected body %+v: %v", a, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	if err := Register(GobType, NewGobCodec); err == nil {
+		t.Fatal("expect an error when registering a duplicate codec")
+	}
+
+	typ := Type("application/x-test")
+	if err := Register(typ, func(conn io.ReadWriteCloser) Codec { return NewGobCodec(conn) }); err != nil {
+		t.Fatal("register codec:", err)
+	}
+	if _, ok := Lookup(typ); !ok {
+		t.Fatal("expect registered codec to be found")
+	}
+	if _, ok := Lookup("application/unknown"); ok {
+		t.Fatal("expect unknown codec type not to be found")
+	}
+}
+
+func TestNewCodecFuncMap(t *testing.T) {
+	if NewCodecFuncMap[GobType] == nil {
+		t.Fatal("expect the deprecated map to hold the registered codecs")
+	}
+	typ := Type("application/x-legacy")
+	NewCodecFuncMap[typ] = NewGobCodec
+	defer delete(NewCodecFuncMap, typ)
+	if _, ok := Lookup(typ); !ok {
+		t.Fatal("expect a codec added to the deprecated map to be found")
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	client, server := net.Pipe()
+	cc, sc := NewProtobufCodec(client), NewProtobufCodec(server)
+	defer func() { _ = cc.Close() }()
+
+	go func() {
+		_ = cc.Write(&Header{ServiceMethod: "Echo.Say", Seq: 1, Metadata: map[string]string{"k": "v"}}, wrapperspb.String("ignored"))
+		_ = cc.Write(&Header{ServiceMethod: "Echo.Say", Seq: 2, Error: "boom", EndStream: true, Window: 32}, struct{}{})
+		_ = cc.Write(&Header{ServiceMethod: "Echo.Say", Seq: 3}, wrapperspb.String("hello"))
+	}()
+
+	var h Header
+	if err := sc.ReadHeader(&h); err != nil || h.ServiceMethod != "Echo.Say" || h.Seq != 1 || h.Metadata["k"] != "v" {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(nil); err != nil {
+		t.Fatal("discard body:", err)
+	}
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 2 || h.Error != "boom" || !h.EndStream || h.Window != 32 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(nil); err != nil {
+		t.Fatal("discard empty body:", err)
+	}
+	var reply wrapperspb.StringValue
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 3 || h.Error != "" {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(&reply); err != nil || reply.GetValue() != "hello" {
+		t.Fatalf("unexpected body %q: %v", reply.GetValue(), err)
+	}
+}
+
+func TestFrameCodec(t *testing.T) {
+	for _, typ := range []Type{GobType, JSONType} {
+		m, ok := LookupMarshaler(typ)
+		if !ok {
+			t.Fatal("no marshaler for", typ)
+		}
+		client, server := net.Pipe()
+		cc, sc := NewFrameCodec(client, m), NewFrameCodec(server, m)
+
+		go func() {
+			_ = cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &args{1, 2})
+			_ = cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &args{3, 4})
+		}()
+
+		var h Header
+		var a args
+		if err := sc.ReadHeader(&h); err != nil || h.Seq != 1 {
+			t.Fatalf("%s: unexpected header %+v: %v", typ, h, err)
+		}
+		if err := sc.ReadBody(nil); err != nil {
+			t.Fatalf("%s: discard body: %v", typ, err)
+		}
+		if err := sc.ReadHeader(&h); err != nil || h.Seq != 2 {
+			t.Fatalf("%s: unexpected header %+v: %v", typ, h, err)
+		}
+		if err := sc.ReadBody(&a); err != nil || a.Num1 != 3 || a.Num2 != 4 {
+			t.Fatalf("%s: unexpected body %+v: %v", typ, a, err)
+		}
+		_ = cc.Close()
+	}
+}
+
+func TestFrameCodec_MaxMsgSize(t *testing.T) {
+	m, _ := LookupMarshaler(JSONType)
+	client, server := net.Pipe()
+	cc, sc := NewFrameCodec(client, m), NewFrameCodec(server, m)
+	defer func() { _ = cc.Close() }()
+	sc.(SizeLimiter).SetMaxMsgSize(256, 0)
+	cc.(SizeLimiter).SetMaxMsgSize(0, 512)
+
+	if err := cc.Write(&Header{Seq: 1}, strings.Repeat("x", 1000)); !isSizeError(err) {
+		t.Fatalf("expect a send size error, got %v", err)
+	}
+	go func() {
+		_ = cc.Write(&Header{Seq: 2}, strings.Repeat("x", 300))
+		_ = cc.Write(&Header{Seq: 3}, "ok")
+	}()
+
+	var h Header
+	var body string
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(&body); !isSizeError(err) {
+		t.Fatalf("expect a receive size error, got %v", err)
+	}
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 3 {
+		t.Fatalf("expect the next message after the skipped one, got %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(&body); err != nil || body != "ok" {
+		t.Fatalf("unexpected body %q: %v", body, err)
+	}
+}
+
+// countingConn counts the bytes written to it.
+type countingConn struct {
+	io.ReadWriteCloser
+	n int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestFrameCodec_GobStream(t *testing.T) {
+	m, _ := LookupMarshaler(GobType)
+	client, server := net.Pipe()
+	conn := &countingConn{ReadWriteCloser: client}
+	cc, sc := NewFrameCodec(conn, m), NewFrameCodec(server, m)
+	defer func() { _ = cc.Close() }()
+	sc.(SizeLimiter).SetMaxMsgSize(256, 0)
+	cc.(SizeLimiter).SetMaxMsgSize(0, 512)
+
+	type big struct{ S string }
+	done := make(chan int)
+	go func() {
+		// the type of big is first encoded by a message that is never sent
+		_ = cc.Write(&Header{Seq: 1}, &big{strings.Repeat("x", 1000)})
+		_ = cc.Write(&Header{Seq: 2}, &big{strings.Repeat("x", 300)})
+		_ = cc.Write(&Header{Seq: 3}, &args{1, 2})
+		_ = cc.Write(&Header{Seq: 4}, &big{"ok"})
+		n := conn.n
+		_ = cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 5}, &args{3, 4})
+		done <- conn.n - n
+	}()
+
+	var h Header
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(&big{}); !isSizeError(err) {
+		t.Fatalf("expect a receive size error, got %v", err)
+	}
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 3 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	raw, err := sc.(RawReader).ReadRawBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b big
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 4 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(&b); err != nil || b.S != "ok" {
+		t.Fatalf("unexpected body %+v: %v", b, err)
+	}
+	if err := sc.ReadHeader(&h); err != nil || h.Seq != 5 {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if err := sc.ReadBody(nil); err != nil {
+		t.Fatal(err)
+	}
+	// the raw body is decoded after the frames that follow it
+	var a args
+	if err := sc.(RawReader).Unmarshal(raw, &a); err != nil || a.Num1 != 1 || a.Num2 != 2 {
+		t.Fatalf("unexpected raw body %+v: %v", a, err)
+	}
+	// the type definitions are sent only once
+	if n := <-done; n > 64 {
+		t.Fatalf("expect a small message once the types are known, got %d bytes", n)
+	}
+}
+
+func isSizeError(err error) bool {
+	_, ok := err.(*MsgSizeError)
+	return ok
+}
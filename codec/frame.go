@@ -0,0 +1,368 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+)
+
+// 二进制分帧协议中，每个 Header 和 Body 都是一个独立的帧：
+// | len(4 bytes, big endian) | payload | len | payload | ...
+// payload 由 Marshaler 单独编码，因此读取方在解码之前就能知道消息的完整长度。
+// 除了 gob 之外，帧与帧之间不共享任何状态；gob 的类型定义在一个连接上只发送一次，
+// 并且总是放在 Header 帧中，见 gobStream。
+
+// Marshaler encodes and decodes a single Header or Body in isolation.
+// It is what the framed protocol needs from a codec type.
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v. A nil v discards the data.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	marshalersMu sync.RWMutex
+	marshalers   = make(map[Type]Marshaler)
+)
+
+// RegisterMarshaler makes a codec type usable with the framed protocol.
+// It returns an error if a Marshaler has already been registered for the type.
+func RegisterMarshaler(typ Type, m Marshaler) error {
+	if typ == "" {
+		return errors.New("rpc codec: register marshaler with empty codec type")
+	}
+	if m == nil {
+		return errors.New("rpc codec: register nil marshaler for " + string(typ))
+	}
+
+	marshalersMu.Lock()
+	defer marshalersMu.Unlock()
+	if _, dup := marshalers[typ]; dup {
+		return errors.New("rpc codec: marshaler already registered: " + string(typ))
+	}
+	marshalers[typ] = m
+	return nil
+}
+
+// LookupMarshaler returns the Marshaler registered for the given type.
+func LookupMarshaler(typ Type) (Marshaler, bool) {
+	marshalersMu.RLock()
+	defer marshalersMu.RUnlock()
+	m, ok := marshalers[typ]
+	return m, ok
+}
+
+func init() {
+	_ = RegisterMarshaler(GobType, gobMarshaler{})
+	_ = RegisterMarshaler(JSONType, jsonMarshaler{})
+	_ = RegisterMarshaler(ProtobufType, protobufMarshaler{})
+}
+
+// ReadFrame reads one length-prefixed frame from r.
+// It never reads past the end of the frame. The length comes from the peer,
+// so use ReadFrameLimit on data that is not trusted yet.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	return readFrame(r, 0)
+}
+
+// ReadFrameLimit reads one length-prefixed frame of at most limit bytes from r.
+// A larger frame is neither allocated nor read, a *MsgSizeError is returned
+// and r is left in the middle of the frame.
+func ReadFrameLimit(r io.Reader, limit int) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if uint64(n) > uint64(limit) {
+		return nil, &MsgSizeError{Size: int(n), Limit: limit}
+	}
+	return readPayload(r, n)
+}
+
+// readFrame reads one frame of at most limit bytes, 0 means no limit.
+// A larger frame is skipped and a *MsgSizeError is returned.
+func readFrame(r io.Reader, limit int) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if limit > 0 && uint64(n) > uint64(limit) {
+		return nil, skipFrame(r, uint64(n), limit)
+	}
+	return readPayload(r, n)
+}
+
+func readPayload(r io.Reader, n uint32) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// skipFrame discards the n bytes of an oversized frame, leaving r at the next frame.
+func skipFrame(r io.Reader, n uint64, limit int) error {
+	if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return &MsgSizeError{Size: int(n), Limit: limit}
+}
+
+// WriteFrame writes data to w as one length-prefixed frame.
+func WriteFrame(w io.Writer, data []byte) error {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// FrameCodec implements Codec on top of the framed protocol.
+type FrameCodec struct {
+	conn io.ReadWriteCloser
+	read *bufio.Reader
+	buff *bufio.Writer
+	m    Marshaler
+	gob  *gobStream // non-nil for GobType, used instead of m
+
+	maxRecv int // 0 means no limit
+	maxSend int
+}
+
+var (
+	_ Codec       = (*FrameCodec)(nil)
+	_ RawReader   = (*FrameCodec)(nil)
+	_ SizeLimiter = (*FrameCodec)(nil)
+)
+
+func NewFrameCodec(conn io.ReadWriteCloser, m Marshaler) Codec {
+	f := &FrameCodec{
+		conn: conn,
+		read: bufio.NewReader(conn),
+		buff: bufio.NewWriter(conn),
+		m:    m,
+	}
+	if _, ok := m.(gobMarshaler); ok {
+		f.gob = newGobStream()
+	}
+	return f
+}
+
+func (f *FrameCodec) SetMaxMsgSize(recv, send int) {
+	f.maxRecv, f.maxSend = recv, send
+}
+
+func (f *FrameCodec) ReadHeader(header *Header) error {
+	data, err := readFrame(f.read, f.maxRecv)
+	if err != nil {
+		return err
+	}
+	return f.Unmarshal(data, header)
+}
+
+func (f *FrameCodec) ReadBody(body interface{}) error {
+	data, err := readFrame(f.read, f.maxRecv)
+	if err != nil {
+		return err
+	}
+	return f.Unmarshal(data, body)
+}
+
+func (f *FrameCodec) ReadRawBody() ([]byte, error) {
+	return readFrame(f.read, f.maxRecv)
+}
+
+func (f *FrameCodec) Unmarshal(data []byte, body interface{}) error {
+	if f.gob != nil {
+		return f.gob.unmarshal(data, body)
+	}
+	return f.m.Unmarshal(data, body)
+}
+
+func (f *FrameCodec) Write(header *Header, body interface{}) (err error) {
+	// 先完成编码再写入，编码失败时不会在连接上留下半个消息
+	h, b, err := f.marshal(header, body)
+	if err != nil {
+		return err
+	}
+	if f.maxSend > 0 && len(b) > f.maxSend {
+		return &MsgSizeError{Size: len(b), Limit: f.maxSend, Send: true}
+	}
+	if f.gob != nil {
+		f.gob.sent()
+	}
+
+	defer func() {
+		_ = f.buff.Flush()
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+	if err = WriteFrame(f.buff, h); err != nil {
+		return err
+	}
+	return WriteFrame(f.buff, b)
+}
+
+func (f *FrameCodec) marshal(header *Header, body interface{}) (h, b []byte, err error) {
+	if f.gob != nil {
+		return f.gob.marshal(header, body)
+	}
+	if h, err = f.m.Marshal(header); err != nil {
+		log.Println("rpc codec: frame encoding header error:", err)
+		return nil, nil, err
+	}
+	if b, err = f.m.Marshal(body); err != nil {
+		log.Println("rpc codec: frame encoding body error:", err)
+		return nil, nil, err
+	}
+	return h, b, nil
+}
+
+func (f *FrameCodec) Close() error {
+	return f.conn.Close()
+}
+
+// gobStream 在一个连接上复用同一对 gob Encoder/Decoder，每种类型的定义只发送一次，
+// 之后的 Header 只有二十字节左右。
+// Encoder 的每次 Write 都是一个完整的 gob 消息，一次 Encode 先写出还没有发送过的类型定义，
+// 最后写出值。类型定义都放进 Header 帧，排在 Header 的值之前，Body 帧只有值，所以 Body 帧
+// 被跳过（见 MaxRecvMsgSize）或者稍后再解码（见 RawReader）都不影响之后的帧。
+// 因为超过 maxSend 而没有发出的消息，其类型定义留到下一个 Header 帧中发送。
+type gobStream struct {
+	enc     *gob.Encoder
+	msgs    gobMessages
+	pending []byte // 已经编码、还没有发出的类型定义
+
+	mu  sync.Mutex // Unmarshal 可能与读循环同时调用
+	dec *gob.Decoder
+	in  *bytes.Reader
+}
+
+func newGobStream() *gobStream {
+	s := &gobStream{in: bytes.NewReader(nil)}
+	s.enc = gob.NewEncoder(&s.msgs)
+	// bytes.Reader 实现了 io.ByteReader，Decoder 不会再包一层 bufio，读到的字节不会超出当前帧
+	s.dec = gob.NewDecoder(s.in)
+	return s
+}
+
+// gobMessages records the messages written by a gob.Encoder, one per Write.
+type gobMessages [][]byte
+
+func (m *gobMessages) Write(p []byte) (int, error) {
+	*m = append(*m, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// encode returns the type definitions and the value written for v.
+func (s *gobStream) encode(v interface{}) (defs, value []byte, err error) {
+	s.msgs = s.msgs[:0]
+	err = s.enc.Encode(v)
+	msgs := s.msgs
+	if err == nil && len(msgs) > 0 {
+		value, msgs = msgs[len(msgs)-1], msgs[:len(msgs)-1]
+	}
+	for _, m := range msgs {
+		defs = append(defs, m...)
+	}
+	return defs, value, err
+}
+
+// marshal encodes one message. The type definitions stay pending until sent is called.
+func (s *gobStream) marshal(header *Header, body interface{}) (h, b []byte, err error) {
+	defs, hv, err := s.encode(header)
+	s.pending = append(s.pending, defs...)
+	if err != nil {
+		log.Println("rpc codec: frame encoding header error:", err)
+		return nil, nil, err
+	}
+	defs, b, err = s.encode(body)
+	s.pending = append(s.pending, defs...)
+	if err != nil {
+		log.Println("rpc codec: frame encoding body error:", err)
+		return nil, nil, err
+	}
+	h = make([]byte, 0, len(s.pending)+len(hv))
+	return append(append(h, s.pending...), hv...), b, nil
+}
+
+// sent records that the frames returned by the last marshal are written.
+func (s *gobStream) sent() {
+	s.pending = s.pending[:0]
+}
+
+func (s *gobStream) unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		// Body 帧只有值，丢弃它不会丢失类型定义
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.in.Reset(data)
+	return s.dec.Decode(v)
+}
+
+// gobMarshaler 每次都使用新的 Encoder/Decoder，类型信息随每个帧一起发送。
+// FrameCodec 不使用它，而是为每个连接创建一个 gobStream。
+type gobMarshaler struct{}
+
+func (gobMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+type protobufMarshaler struct{}
+
+func (protobufMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if h, ok := v.(*Header); ok {
+		return marshalHeader(h), nil
+	}
+	return marshalProto(v)
+}
+
+func (protobufMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if h, ok := v.(*Header); ok {
+		return unmarshalHeader(data, h)
+	}
+	return unmarshalProto(data, v)
+}
@@ -1,6 +1,9 @@
 package codec
 
-import "io"
+import (
+	"fmt"
+	"io"
+)
 
 // codec package 主要负责编解码相关的工作
 type Codec interface {
@@ -9,3 +12,45 @@ type Codec interface {
 	ReadBody(interface{}) error
 	Write(*Header, interface{}) error
 }
+
+// RawReader is implemented by codecs that can read a body without decoding
+// it, and decode it later. Streams need it because the receiving loop does
+// not know the type of a stream message until the user asks for it.
+// GobCodec cannot decode a message out of its stream, so it does not
+// implement RawReader; FrameCodec, JSONCodec and ProtobufCodec do.
+type RawReader interface {
+	ReadRawBody() ([]byte, error)
+	Unmarshal(data []byte, body interface{}) error
+}
+
+// SizeLimiter is implemented by codecs that know the size of a message before
+// decoding it, so that they can refuse large messages without holding them in
+// memory. FrameCodec and ProtobufCodec implement it; GobCodec and JSONCodec
+// decode straight from the connection and cannot.
+type SizeLimiter interface {
+	// SetMaxMsgSize sets the largest message that may be read and written,
+	// in bytes. 0 means no limit.
+	SetMaxMsgSize(recv, send int)
+}
+
+// MsgSizeError is returned by codecs that implement SizeLimiter when a message
+// is over the limit. The message has been skipped, or was not written at all,
+// so the connection can still be used. Size is 0 when the size of the message
+// was not known before reading it; the rest of the message is then left unread
+// and the connection cannot be used any more.
+type MsgSizeError struct {
+	Size  int
+	Limit int
+	Send  bool // the message was being written rather than read
+}
+
+func (e *MsgSizeError) Error() string {
+	op := "received"
+	if e.Send {
+		op = "sent"
+	}
+	if e.Size <= 0 {
+		return fmt.Sprintf("rpc codec: %s message larger than max (%d)", op, e.Limit)
+	}
+	return fmt.Sprintf("rpc codec: %s message larger than max (%d vs. %d)", op, e.Size, e.Limit)
+}
@@ -0,0 +1,79 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+type JSONCodec struct {
+	conn   io.ReadWriteCloser
+	buff   *bufio.Writer
+	decode *json.Decoder
+	encode *json.Encoder
+}
+
+var (
+	_ Codec     = (*JSONCodec)(nil)
+	_ RawReader = (*JSONCodec)(nil)
+)
+
+func NewJSONCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JSONCodec{
+		conn:   conn,
+		buff:   buf,
+		decode: json.NewDecoder(conn),
+		encode: json.NewEncoder(buf),
+	}
+}
+
+func (j *JSONCodec) ReadHeader(header *Header) error {
+	return j.decode.Decode(header)
+}
+
+// ReadBody 在 body 为 nil 时丢弃下一个 JSON 值，与 gob 的行为保持一致
+func (j *JSONCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		var discard json.RawMessage
+		return j.decode.Decode(&discard)
+	}
+	return j.decode.Decode(body)
+}
+
+func (j *JSONCodec) ReadRawBody() ([]byte, error) {
+	var raw json.RawMessage
+	err := j.decode.Decode(&raw)
+	return raw, err
+}
+
+func (j *JSONCodec) Unmarshal(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return json.Unmarshal(data, body)
+}
+
+func (j *JSONCodec) Write(header *Header, body interface{}) (err error) {
+	defer func() {
+		_ = j.buff.Flush()
+		if err != nil {
+			_ = j.Close()
+		}
+	}()
+
+	if err := j.encode.Encode(header); err != nil {
+		log.Println("rpc codec: json encoding header error:", err)
+		return err
+	}
+	if err := j.encode.Encode(body); err != nil {
+		log.Println("rpc codec: json encoding body error:", err)
+		return err
+	}
+	return nil
+}
+
+func (j *JSONCodec) Close() error {
+	return j.conn.Close()
+}
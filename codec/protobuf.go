@@ -0,0 +1,309 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec 使用 protobuf 编码 Header 和 Body，
+// 每个消息前都带有一个 uvarint 编码的长度前缀：
+// | len | Header | len | Body | len | Header | len | Body | ...
+// Body 必须实现 proto.Message；Header 不是 proto 生成的类型，手动按字段编码。
+type ProtobufCodec struct {
+	conn io.ReadWriteCloser
+	read *bufio.Reader
+	buff *bufio.Writer
+
+	maxRecv int // 0 means no limit
+	maxSend int
+}
+
+var (
+	_ Codec       = (*ProtobufCodec)(nil)
+	_ RawReader   = (*ProtobufCodec)(nil)
+	_ SizeLimiter = (*ProtobufCodec)(nil)
+)
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		read: bufio.NewReader(conn),
+		buff: bufio.NewWriter(conn),
+	}
+}
+
+func (p *ProtobufCodec) SetMaxMsgSize(recv, send int) {
+	p.maxRecv, p.maxSend = recv, send
+}
+
+func (p *ProtobufCodec) ReadHeader(header *Header) error {
+	data, err := p.readFrame()
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(data, header)
+}
+
+func (p *ProtobufCodec) ReadBody(body interface{}) error {
+	data, err := p.readFrame()
+	if err != nil {
+		return err
+	}
+	return unmarshalProto(data, body)
+}
+
+func (p *ProtobufCodec) ReadRawBody() ([]byte, error) {
+	return p.readFrame()
+}
+
+func (p *ProtobufCodec) Unmarshal(data []byte, body interface{}) error {
+	return unmarshalProto(data, body)
+}
+
+func (p *ProtobufCodec) Write(header *Header, body interface{}) (err error) {
+	// 先完成编码再写入，编码失败或者超过大小限制时不会在连接上留下半个消息
+	data, err := marshalProto(body)
+	if err != nil {
+		log.Println("rpc codec: protobuf encoding body error:", err)
+		return err
+	}
+	if p.maxSend > 0 && len(data) > p.maxSend {
+		return &MsgSizeError{Size: len(data), Limit: p.maxSend, Send: true}
+	}
+
+	defer func() {
+		_ = p.buff.Flush()
+		if err != nil {
+			_ = p.Close()
+		}
+	}()
+
+	if err := p.writeFrame(marshalHeader(header)); err != nil {
+		log.Println("rpc codec: protobuf encoding header error:", err)
+		return err
+	}
+	if err := p.writeFrame(data); err != nil {
+		log.Println("rpc codec: protobuf encoding body error:", err)
+		return err
+	}
+	return nil
+}
+
+func (p *ProtobufCodec) Close() error {
+	return p.conn.Close()
+}
+
+func (p *ProtobufCodec) readFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(p.read)
+	if err != nil {
+		return nil, err
+	}
+	if p.maxRecv > 0 && n > uint64(p.maxRecv) {
+		return nil, skipFrame(p.read, n, p.maxRecv)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(p.read, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (p *ProtobufCodec) writeFrame(data []byte) error {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(data)))
+	if _, err := p.buff.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := p.buff.Write(data)
+	return err
+}
+
+// marshalProto 编码 body。服务端回复错误时 body 为空结构体，此时编码为空消息。
+func marshalProto(body interface{}) ([]byte, error) {
+	switch b := body.(type) {
+	case nil, struct{}:
+		return nil, nil
+	case proto.Message:
+		return proto.Marshal(b)
+	default:
+		return nil, fmt.Errorf("rpc codec: %T does not implement proto.Message", body)
+	}
+}
+
+// unmarshalProto 解码 body，body 为 nil 时丢弃该消息
+func unmarshalProto(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return fmt.Errorf("rpc codec: %T does not implement proto.Message", body)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// Header 的字段编号，新增字段时只能追加，不能修改已有编号
+const (
+	headerServiceMethod protowire.Number = 1
+	headerSeq           protowire.Number = 2
+	headerError         protowire.Number = 3
+	headerTimeout       protowire.Number = 4
+	headerKind          protowire.Number = 5
+	headerMetadata      protowire.Number = 6 // map<string, string>
+	headerCode          protowire.Number = 7
+	headerDetails       protowire.Number = 8 // repeated string
+	headerEndStream     protowire.Number = 9
+	headerWindow        protowire.Number = 10
+)
+
+func marshalHeader(h *Header) []byte {
+	var b []byte
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, headerServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, headerSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, headerError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, headerTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Kind != KindCall {
+		b = protowire.AppendTag(b, headerKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Kind))
+	}
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, headerCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	if h.EndStream {
+		b = protowire.AppendTag(b, headerEndStream, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if h.Window != 0 {
+		b = protowire.AppendTag(b, headerWindow, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Window))
+	}
+	for _, d := range h.Details {
+		b = protowire.AppendTag(b, headerDetails, protowire.BytesType)
+		b = protowire.AppendString(b, d)
+	}
+	for k, v := range h.Metadata {
+		// map 的每一项编码为一个 {1: key, 2: value} 的子消息
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, headerMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalMapEntry(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", errInvalidHeader
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", errInvalidHeader
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
+
+var errInvalidHeader = errors.New("rpc codec: invalid protobuf header")
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errInvalidHeader
+		}
+		b = b[n:]
+
+		switch {
+		case num == headerServiceMethod && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == headerSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == headerError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == headerTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == headerKind && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Kind = Kind(v)
+		case num == headerCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(v)
+		case num == headerEndStream && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.EndStream = v != 0
+		case num == headerWindow && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Window = uint32(v)
+		case num == headerDetails && typ == protowire.BytesType:
+			var d string
+			d, n = protowire.ConsumeString(b)
+			h.Details = append(h.Details, d)
+		case num == headerMetadata && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(b); n < 0 {
+				break
+			}
+			k, v, err := unmarshalMapEntry(entry)
+			if err != nil {
+				return err
+			}
+			if h.Metadata == nil {
+				h.Metadata = make(map[string]string)
+			}
+			h.Metadata[k] = v
+		default:
+			// 跳过不认识的字段，保证新旧版本之间可以互通
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errInvalidHeader
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -9,7 +9,7 @@ import (
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
@@ -17,12 +17,29 @@ const debugText = `<html>
 		<th align=center>Method</th><th align=center>Calls</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.RetType}}) error</td>
+			<td align=left font=fixed>{{$name}}({{with $mtype.ArgType}}{{.}}, {{end}}{{$mtype.RetType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
 			</tr>
 		{{end}}
 		</table>
 	{{end}}
+	{{with .Limits}}
+	<hr>
+	Rate limits
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Rate</th><th align=center>Burst</th><th align=center>Tokens</th><th align=center>Rejected</th>
+		{{range .}}
+			<tr>
+			<td align=left font=fixed>{{.Pattern}}</td>
+			<td align=center>{{.Limit.Rate}}/s</td>
+			<td align=center>{{.Limit.Burst}}</td>
+			<td align=center>{{if .Limit.PerClient}}per client, {{.Clients}} clients{{else}}{{printf "%.1f" .Tokens}}{{end}}</td>
+			<td align=center>{{.Rejected}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
 	</body>
 	</html>`
 
@@ -38,6 +55,15 @@ type debugService struct {
 }
 
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := server.authorizeHTTP(req); err != nil {
+		status := http.StatusForbidden
+		if CodeOf(err) == Unauthenticated {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	var services []debugService
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*service)
@@ -47,7 +73,10 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debugTpl.Execute(w, services)
+	err := debugTpl.Execute(w, struct {
+		Services []debugService
+		Limits   []debugLimit
+	}{services, server.limits.debug()})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
@@ -85,7 +85,8 @@ func broadcast(registry string) {
 			args := Args{i, i * i}
 			foo(context.Background(), client, "broadcast", "Foo.Sum", &args)
 
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			foo(ctx, client, "broadcast", "Foo.Sleep", &args)
 		}(i)
 	}
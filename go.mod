@@ -1,3 +1,8 @@
 module github.com/devhg/drpc
 
 go 1.16
+
+require (
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
+)
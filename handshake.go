@@ -0,0 +1,204 @@
+package drpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/devhg/drpc/codec"
+)
+
+// 二进制握手（ProtocolVersion >= 1）
+// client -> server: | MagicNumber(4 bytes) | version(1 byte) | frame(Option, JSON 编码) |
+// server -> client: | MagicNumber(4 bytes) | version(1 byte) | frame(错误信息，空表示接受) |
+// 之后的 Header 和 Body 都是独立的帧，详见 codec.FrameCodec。
+//
+// 旧的 JSON 握手直接以 Option 的 JSON 对象开头，第一个字节一定是 '{' 或空白字符，
+// 而 MagicNumber 的第一个字节是 0，服务端据此区分两种握手。
+
+// ProtocolVersion is the highest version of the framed protocol this package speaks.
+const ProtocolVersion = 1
+
+const preambleLen = 5
+
+// maxHandshakeFrame bounds the Option and the answer of the server, which are
+// read before the peer is authenticated.
+const maxHandshakeFrame = 64 << 10
+
+var errBadPreamble = errors.New("rpc: invalid protocol preamble")
+
+func writePreamble(w io.Writer, version byte) error {
+	var p [preambleLen]byte
+	binary.BigEndian.PutUint32(p[:4], MagicNumber)
+	p[4] = version
+	_, err := w.Write(p[:])
+	return err
+}
+
+func readPreamble(r io.Reader) (byte, error) {
+	var p [preambleLen]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(p[:4]) != MagicNumber {
+		return 0, errBadPreamble
+	}
+	return p[4], nil
+}
+
+// isFramed reports whether the peer opened the connection with the binary preamble.
+func isFramed(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == 0, nil
+}
+
+// clientHandshake sends the Option using the framed protocol
+// and waits for the server to accept it.
+func clientHandshake(conn io.ReadWriter, opt *Option) error {
+	data, err := json.Marshal(opt)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(conn)
+	_ = writePreamble(w, ProtocolVersion)
+	_ = codec.WriteFrame(w, data)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	version, err := readPreamble(conn)
+	if err != nil {
+		return err
+	}
+	if version == 0 || version > ProtocolVersion {
+		return fmt.Errorf("rpc client: unsupported protocol version %d", version)
+	}
+	reason, err := codec.ReadFrameLimit(conn, maxHandshakeFrame)
+	if err != nil {
+		return err
+	}
+	if len(reason) > 0 {
+		return errors.New(string(reason))
+	}
+	return nil
+}
+
+// serverHandshake reads the Option sent by clientHandshake and
+// returns it along with the protocol version both sides will speak.
+func serverHandshake(r io.Reader) (*Option, byte, error) {
+	version, err := readPreamble(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version == 0 {
+		return nil, 0, errBadPreamble
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	data, err := codec.ReadFrameLimit(r, maxHandshakeFrame)
+	if err != nil {
+		return nil, 0, err
+	}
+	var opt Option
+	if err := json.Unmarshal(data, &opt); err != nil {
+		return nil, 0, err
+	}
+	return &opt, version, nil
+}
+
+// acceptHandshake answers clientHandshake. A non-nil reason rejects the client.
+func acceptHandshake(w io.Writer, version byte, reason error) error {
+	var msg []byte
+	if reason != nil {
+		msg = []byte(reason.Error())
+	}
+	bw := bufio.NewWriter(w)
+	_ = writePreamble(bw, version)
+	_ = codec.WriteFrame(bw, msg)
+	return bw.Flush()
+}
+
+// bufferedConn reads through a buffer that may already hold bytes read
+// during the handshake, and writes and closes through the raw connection.
+type bufferedConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// newLegacyCodec creates the codec of a connection that made the legacy JSON
+// handshake, reading from r. GobCodec and JSONCodec decode straight from the
+// connection and cannot tell the size of a message before reading it, so the
+// receive limit set by SetMaxMsgSize is enforced on the bytes they read: a
+// message whose Header and body need more bytes than the limit fails to decode,
+// and the connection cannot be used after that. The send limit is not enforced.
+func newLegacyCodec(newCodec codec.NewCodecFunc, r io.Reader, conn io.ReadWriteCloser) codec.Codec {
+	lr := &msgLimitReader{r: r}
+	cc := newCodec(&bufferedConn{lr, conn})
+	if _, ok := cc.(codec.SizeLimiter); ok {
+		return cc
+	}
+	lc := &limitedCodec{cc, lr}
+	if raw, ok := cc.(codec.RawReader); ok {
+		return &limitedRawCodec{lc, raw}
+	}
+	return lc
+}
+
+// limitedCodec enforces the receive limit of a codec that cannot, see newLegacyCodec.
+type limitedCodec struct {
+	codec.Codec
+	r *msgLimitReader
+}
+
+type limitedRawCodec struct {
+	*limitedCodec
+	codec.RawReader
+}
+
+func (c *limitedCodec) SetMaxMsgSize(recv, _ int) {
+	c.r.limit = recv
+}
+
+// ReadHeader starts a new message. Bytes read ahead for it by the codec
+// were counted in the previous message.
+func (c *limitedCodec) ReadHeader(h *codec.Header) error {
+	c.r.left = c.r.limit
+	return c.Codec.ReadHeader(h)
+}
+
+// msgLimitReader reads at most limit bytes per message, 0 means no limit.
+// Once a message is over the limit the rest of it is never read, so every
+// following read fails too.
+type msgLimitReader struct {
+	r     io.Reader
+	limit int
+	left  int
+	err   error
+}
+
+func (l *msgLimitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+	if l.left <= 0 {
+		l.err = &codec.MsgSizeError{Limit: l.limit}
+		return 0, l.err
+	}
+	if len(p) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= n
+	return n, err
+}
@@ -0,0 +1,75 @@
+package drpc
+
+import "context"
+
+// Handler handles one decoded request. The innermost Handler calls the
+// service method; argv and replyv are the values passed to it.
+type Handler func(ctx context.Context, serviceMethod string, argv, replyv interface{}) error
+
+// ServerInterceptor wraps the handling of a request. It may inspect or
+// modify argv and replyv, and either call next or return an error without
+// calling it. A non-nil error is sent to the client in codec.Header.Error.
+// next calls the method named by the serviceMethod it is given with the argv
+// and replyv it is given, which must have the types of the method's arguments,
+// so an interceptor may also replace them. The reply sent to the client is
+// always the replyv the interceptor received.
+type ServerInterceptor func(ctx context.Context, serviceMethod string,
+	argv, replyv interface{}, next Handler) error
+
+// Use appends interceptors to the server's chain. The first interceptor
+// is the outermost one, i.e. the first to see a request.
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// chain wraps h with the interceptors registered so far.
+func (server *Server) chain(h Handler) Handler {
+	server.mu.Lock()
+	interceptors := server.interceptors
+	server.mu.Unlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, serviceMethod string, argv, replyv interface{}) error {
+			return interceptor(ctx, serviceMethod, argv, replyv, next)
+		}
+	}
+	return h
+}
+
+// Invoker sends a call and waits for its reply.
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// ClientInterceptor wraps an outgoing call. It may observe or replace
+// serviceMethod, args and reply before calling invoker, and observe or
+// replace the error it returns.
+type ClientInterceptor func(ctx context.Context, serviceMethod string,
+	args, reply interface{}, invoker Invoker) error
+
+// ChainClientInterceptors wraps invoker with interceptors, the first
+// interceptor being the outermost one.
+func ChainClientInterceptors(invoker Invoker, interceptors ...ClientInterceptor) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// Use appends interceptors to the client's chain. They wrap every Call and Go.
+func (c *Client) Use(interceptors ...ClientInterceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
+func (c *Client) chain() (Invoker, bool) {
+	c.mu.Lock()
+	interceptors := c.interceptors
+	c.mu.Unlock()
+	return ChainClientInterceptors(c.invoke, interceptors...), len(interceptors) > 0
+}
@@ -0,0 +1,273 @@
+package drpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 过载保护分为两层：
+// 1) 并发上限：整个 Server 以及单个方法同时处理的请求数，超出的请求在有界队列中等待空位，
+//    队列也满了则立即返回 ResourceExhausted。
+// 2) 自适应削峰：按照观察到的处理延迟调整并发上限（AIMD），延迟超过目标时按比例收缩，
+//    否则缓慢增长，超出上限的请求立即返回 ResourceExhausted。
+// 请求在读循环中预留位置，因此被拒绝的请求不会创建 goroutine；等待发生在请求自己的 goroutine 中。
+
+const (
+	shedInitialLimit = 64
+	shedMinLimit     = 4
+	shedMaxLimit     = 10000
+	shedBackoff      = 0.9 // 每次收缩保留的比例
+)
+
+// ConcurrencyLimit bounds how many requests are handled at the same time.
+type ConcurrencyLimit struct {
+	Max int // requests handled at the same time
+	// Queue is how many more requests may wait for one of them to finish.
+	// Requests beyond it are rejected with ResourceExhausted; 0 rejects them
+	// right away. Waiting requests give up when their deadline passes.
+	Queue int
+}
+
+// WithConcurrencyLimit limits the requests the server handles at the same
+// time, over all connections.
+func WithConcurrencyLimit(l ConcurrencyLimit) ServerOption {
+	return func(server *Server) {
+		server.loadLimiter().global = newSemaphore("server", l)
+	}
+}
+
+// WithMethodConcurrencyLimit limits the requests handled at the same time for
+// the methods matched by method, which is "Service.Method" or "Service.*".
+// A method is limited by its most specific pattern only.
+func WithMethodConcurrencyLimit(method string, l ConcurrencyLimit) ServerOption {
+	return func(server *Server) {
+		server.loadLimiter().methods[method] = newSemaphore(method, l)
+	}
+}
+
+// WithLoadShedding rejects requests with ResourceExhausted when the server
+// falls behind. The number of requests handled at the same time is cut down
+// while requests take longer than target to handle, and grows back while
+// they do not. Streaming methods are counted but do not take part in
+// measuring latency.
+func WithLoadShedding(target time.Duration) ServerOption {
+	return func(server *Server) {
+		server.loadLimiter().shed = &shedder{target: target, limit: shedInitialLimit}
+	}
+}
+
+func (server *Server) loadLimiter() *loadLimiter {
+	if server.load == nil {
+		server.load = &loadLimiter{methods: make(map[string]*semaphore)}
+	}
+	return server.load
+}
+
+// semaphore admits Max requests at a time and lets Queue more wait.
+type semaphore struct {
+	name  string
+	limit ConcurrencyLimit
+	slots chan struct{}
+
+	mu      sync.Mutex
+	pending int // requests running or waiting
+}
+
+func newSemaphore(name string, l ConcurrencyLimit) *semaphore {
+	if l.Max < 1 {
+		l.Max = 1
+	}
+	if l.Queue < 0 {
+		l.Queue = 0
+	}
+	return &semaphore{name: name, limit: l, slots: make(chan struct{}, l.Max)}
+}
+
+// reserve makes room for a request, without waiting.
+func (s *semaphore) reserve() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending >= s.limit.Max+s.limit.Queue {
+		return Errorf(ResourceExhausted, "rpc server: too many concurrent requests for %s, limit %d", s.name, s.limit.Max)
+	}
+	s.pending++
+	return nil
+}
+
+// unreserve gives back a reservation that did not get a slot.
+func (s *semaphore) unreserve() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+}
+
+// acquire waits for a slot for a reserved request.
+func (s *semaphore) acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		s.unreserve()
+		return Errorf(ResourceExhausted, "rpc server: gave up waiting for %s: %v", s.name, ctx.Err())
+	}
+}
+
+func (s *semaphore) release() {
+	<-s.slots
+	s.unreserve()
+}
+
+// shedder keeps an adaptive concurrency limit, see WithLoadShedding.
+type shedder struct {
+	target time.Duration
+
+	mu           sync.Mutex
+	limit        float64
+	inflight     int
+	lastDecrease time.Time
+}
+
+func (s *shedder) admit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight >= int(s.limit) {
+		return Errorf(ResourceExhausted, "rpc server: overloaded, %d requests in flight", s.inflight)
+	}
+	s.inflight++
+	return nil
+}
+
+// done records the latency of a request, or -1 for requests that do not count.
+func (s *shedder) done(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	switch {
+	case latency < 0:
+	case latency > s.target:
+		// 同一批慢请求只收缩一次，避免上限在一瞬间跌到底
+		if now := time.Now(); now.Sub(s.lastDecrease) > s.target {
+			s.lastDecrease = now
+			s.limit *= shedBackoff
+			if s.limit < shedMinLimit {
+				s.limit = shedMinLimit
+			}
+		}
+	case s.inflight*2 >= int(s.limit):
+		// 只有上限确实被用到时才增长，每 limit 个请求增长 1
+		s.limit += 1 / s.limit
+		if s.limit > shedMaxLimit {
+			s.limit = shedMaxLimit
+		}
+	}
+}
+
+// loadLimiter holds the limits of the options above, which are fixed once
+// the server is created.
+type loadLimiter struct {
+	global  *semaphore
+	methods map[string]*semaphore // pattern -> semaphore
+	shed    *shedder
+}
+
+// loadSlot is what a request holds while it is handled.
+type loadSlot struct {
+	method, global *semaphore
+	shed           *shedder
+	stream         bool
+	start          time.Time
+}
+
+// reserve admits the request to serviceMethod or rejects it right away.
+// A nil limiter admits everything.
+func (l *loadLimiter) reserve(serviceMethod string, stream bool) (*loadSlot, error) {
+	if l == nil {
+		return nil, nil
+	}
+	slot := &loadSlot{global: l.global, stream: stream}
+	if slot.method = l.methods[serviceMethod]; slot.method == nil {
+		if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+			slot.method = l.methods[serviceMethod[:dot]+".*"]
+		}
+	}
+
+	if l.shed != nil {
+		if err := l.shed.admit(); err != nil {
+			return nil, err
+		}
+		slot.shed = l.shed
+	}
+	if slot.method != nil {
+		if err := slot.method.reserve(); err != nil {
+			slot.cancel()
+			return nil, err
+		}
+	}
+	if slot.global != nil {
+		if err := slot.global.reserve(); err != nil {
+			if slot.method != nil {
+				slot.method.unreserve()
+			}
+			slot.cancel()
+			return nil, err
+		}
+	}
+	return slot, nil
+}
+
+// cancel gives back the place in the shedder of a request that is not handled.
+func (s *loadSlot) cancel() {
+	if s.shed != nil {
+		s.shed.done(-1)
+	}
+}
+
+// acquire waits until the request may be handled. The method slot is taken
+// first, so that requests waiting for a busy method do not hold server slots.
+func (s *loadSlot) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	if s.method != nil {
+		if err := s.method.acquire(ctx); err != nil {
+			if s.global != nil {
+				s.global.unreserve()
+			}
+			s.cancel()
+			return err
+		}
+	}
+	if s.global != nil {
+		if err := s.global.acquire(ctx); err != nil {
+			if s.method != nil {
+				s.method.release()
+			}
+			s.cancel()
+			return err
+		}
+	}
+	s.start = time.Now()
+	return nil
+}
+
+// release is called once the method of the request has returned.
+func (s *loadSlot) release() {
+	if s == nil {
+		return
+	}
+	if s.global != nil {
+		s.global.release()
+	}
+	if s.method != nil {
+		s.method.release()
+	}
+	if s.shed != nil {
+		latency := time.Since(s.start)
+		if s.stream {
+			latency = -1
+		}
+		s.shed.done(latency)
+	}
+}
@@ -0,0 +1,130 @@
+package drpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/devhg/drpc/codec"
+)
+
+// Gate blocks its callers until open is closed.
+type Gate struct {
+	entered chan struct{}
+	open    chan struct{}
+}
+
+func (g *Gate) Wait(_ int, reply *int) error {
+	g.entered <- struct{}{}
+	<-g.open
+	*reply = 1
+	return nil
+}
+
+func TestServer_ConcurrencyLimit(t *testing.T) {
+	gate := &Gate{entered: make(chan struct{}, 8), open: make(chan struct{})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	server := NewServer(WithMethodConcurrencyLimit("Gate.Wait", ConcurrencyLimit{Max: 1, Queue: 1}))
+	_ = server.Register(gate)
+	go server.Accept(l)
+	defer func() { _ = server.Close() }()
+
+	client, err := Dial("tcp", l.Addr().String())
+	assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	done := make(chan error, 2)
+	wait := func() {
+		var reply int
+		done <- client.Call(context.Background(), "Gate.Wait", 0, &reply)
+	}
+	go wait()
+	<-gate.entered
+	go wait()
+	waitPending(server.load.methods["Gate.Wait"], 2) // 第二个请求在队列中等待
+
+	var reply int
+	err = client.Call(context.Background(), "Gate.Wait", 0, &reply)
+	assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted when the queue is full, got %v", err)
+	select {
+	case <-gate.entered:
+		t.Fatal("expect the queued request to wait for the running one")
+	default:
+	}
+
+	close(gate.open)
+	for i := 0; i < 2; i++ {
+		err := <-done
+		assert(err == nil, "expect admitted requests to succeed, got %v", err)
+	}
+}
+
+// waitPending waits until n requests run or wait in s.
+func waitPending(s *semaphore, n int) {
+	for i := 0; i < 200; i++ {
+		s.mu.Lock()
+		pending := s.pending
+		s.mu.Unlock()
+		if pending == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	panic(fmt.Sprintf("expect %d pending requests", n))
+}
+
+func TestServer_ConcurrencyLimitCancel(t *testing.T) {
+	gate := &Gate{entered: make(chan struct{}, 8), open: make(chan struct{})}
+	server := NewServer(WithMethodConcurrencyLimit("Gate.Wait", ConcurrencyLimit{Max: 1, Queue: 1}))
+	_ = server.Register(gate)
+	_ = server.Register(new(Foo))
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(codec.NewGobCodec(serverConn), 0)
+	cc := codec.NewGobCodec(clientConn)
+	defer func() { _ = cc.Close() }()
+
+	_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Wait", Seq: 1}, 0)
+	<-gate.entered
+	_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Wait", Seq: 2}, 0)
+	sem := server.load.methods["Gate.Wait"]
+	waitPending(sem, 2)
+	// 取消排队中的请求，它不会得到回复
+	_ = cc.Write(&codec.Header{Seq: 2, Kind: codec.KindCancel}, struct{}{})
+	waitPending(sem, 1)
+	go func() { _ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 3}, Args{Num1: 1, Num2: 2}) }()
+
+	var h codec.Header
+	var sum int
+	assert(cc.ReadHeader(&h) == nil && h.Seq == 3, "expect no reply to the canceled request, got %+v", h)
+	assert(cc.ReadBody(&sum) == nil && sum == 3, "expect the sum")
+	close(gate.open)
+	assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "expect the running request to succeed, got %+v", h)
+}
+
+func TestShedder(t *testing.T) {
+	s := &shedder{target: time.Millisecond, limit: shedInitialLimit}
+	for i := 0; i < 3; i++ {
+		assert(s.admit() == nil, "expect a request to be admitted")
+		s.done(time.Second)
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert(s.limit < shedInitialLimit*shedBackoff*shedBackoff, "expect slow requests to cut the limit, got %v", s.limit)
+
+	// 上限收缩到最小值之后，超出的请求被拒绝
+	s.limit = shedMinLimit
+	for i := 0; i < shedMinLimit; i++ {
+		assert(s.admit() == nil, "expect request %d to be admitted", i)
+	}
+	err := s.admit()
+	assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted, got %v", err)
+
+	// 快速完成的请求让上限重新增长
+	limit := s.limit
+	for i := 0; i < shedMinLimit; i++ {
+		s.done(0)
+	}
+	assert(s.limit > limit, "expect fast requests to grow the limit")
+}
@@ -0,0 +1,120 @@
+package drpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Metadata is the key/value data carried in codec.Header alongside a call,
+// such as auth tokens, trace IDs or tenant IDs.
+// Requests carry the caller's metadata, responses carry the handler's trailer.
+type Metadata map[string]string
+
+// Pairs returns a Metadata built from key, value pairs.
+// A trailing key without value is ignored.
+func Pairs(kv ...string) Metadata {
+	md := make(Metadata, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Copy returns a copy of md.
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type trailerKey struct{}
+type trailerCaptureKey struct{}
+
+// NewOutgoingContext returns a context whose calls send md to the server.
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a context whose calls send the metadata
+// already in ctx plus the given key, value pairs.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	md = md.Copy()
+	if md == nil {
+		md = make(Metadata, len(kv)/2)
+	}
+	for k, v := range Pairs(kv...) {
+		md[k] = v
+	}
+	return NewOutgoingContext(ctx, md)
+}
+
+// FromOutgoingContext returns the metadata that calls made with ctx will send.
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(Metadata)
+	return md, ok
+}
+
+// FromIncomingContext returns the metadata the client sent with the request
+// being handled. It is meant for service methods and ServerInterceptors.
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingKey{}).(Metadata)
+	return md, ok
+}
+
+// trailer collects what handlers pass to SetTrailer.
+type trailer struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+func (t *trailer) metadata() Metadata {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md.Copy()
+}
+
+// newIncomingContext returns the context a request is handled with.
+func newIncomingContext(ctx context.Context, md Metadata) (context.Context, *trailer) {
+	t := new(trailer)
+	ctx = context.WithValue(ctx, incomingKey{}, md)
+	return context.WithValue(ctx, trailerKey{}, t), t
+}
+
+// SetTrailer adds md to the trailer sent back with the response of the
+// request handled with ctx. Later values replace earlier ones.
+func SetTrailer(ctx context.Context, md Metadata) error {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return errors.New("rpc server: SetTrailer called outside of a request")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil {
+		t.md = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		t.md[k] = v
+	}
+	return nil
+}
+
+// WithTrailer returns a context that makes Client.Call store the trailer
+// of the response in *md.
+func WithTrailer(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, trailerCaptureKey{}, md)
+}
+
+func captureTrailer(ctx context.Context, md Metadata) {
+	if p, ok := ctx.Value(trailerCaptureKey{}).(*Metadata); ok {
+		*p = md
+	}
+}
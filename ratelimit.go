@@ -0,0 +1,210 @@
+package drpc
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限流使用令牌桶，规则按方法匹配，"Service.Method"、"Service.*" 和 "*" 三种规则
+// 都会生效，请求必须从每个匹配的桶里各拿到一个令牌，否则返回 ResourceExhausted。
+// PerClient 的规则为每个调用方单独维护一个桶，调用方的身份与 Policy 相同，
+// 匿名调用方按 IP 区分。
+
+// maxIdleBuckets 是 PerClient 规则最多保留的桶的数量，达到时先丢弃已经装满的桶，
+// 装满的桶与新建的桶没有区别；没有装满的桶时丢弃最久没有使用的桶，
+// 它的调用方下次会得到一个新桶。
+const maxIdleBuckets = 1024
+
+// Limit describes a token bucket: Rate calls per second on average,
+// with bursts of up to Burst calls.
+type Limit struct {
+	Rate  float64
+	Burst int // at least 1
+	// PerClient gives every caller a bucket of its own.
+	PerClient bool
+}
+
+// WithRateLimit limits the calls to the methods matched by method, which is
+// "Service.Method", "Service.*" or "*" for the whole server. A call must get
+// through the limits of every pattern it matches.
+func WithRateLimit(method string, limit Limit) ServerOption {
+	return func(server *Server) {
+		if server.limits == nil {
+			server.limits = &rateLimiter{rules: make(map[string]*rateRule)}
+		}
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		server.limits.rules[method] = &rateRule{
+			pattern: method,
+			limit:   limit,
+			buckets: make(map[string]*tokenBucket),
+		}
+	}
+}
+
+// tokenBucket holds tokens as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(l Limit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if max := float64(l.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+type rateRule struct {
+	pattern string
+	limit   Limit
+
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket // client -> bucket, "" if not PerClient
+	rejected uint64
+}
+
+// take takes a token of client's bucket.
+func (r *rateRule) take(client string, now time.Time) bool {
+	if !r.limit.PerClient {
+		client = ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.buckets[client]
+	if b == nil {
+		if len(r.buckets) >= maxIdleBuckets {
+			r.prune(now)
+		}
+		b = &tokenBucket{tokens: float64(r.limit.Burst), last: now}
+		r.buckets[client] = b
+	}
+	b.refill(r.limit, now)
+	if b.tokens < 1 {
+		r.rejected++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// giveBack returns the token taken by take, when another rule rejected the call.
+func (r *rateRule) giveBack(client string) {
+	if !r.limit.PerClient {
+		client = ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b := r.buckets[client]; b != nil && b.tokens+1 <= float64(r.limit.Burst) {
+		b.tokens++
+	}
+}
+
+// prune makes room for a new bucket, see maxIdleBuckets.
+func (r *rateRule) prune(now time.Time) {
+	var lru string
+	var lruLast time.Time
+	for client, b := range r.buckets {
+		if lruLast.IsZero() || b.last.Before(lruLast) {
+			lru, lruLast = client, b.last
+		}
+		b.refill(r.limit, now)
+		if b.tokens >= float64(r.limit.Burst) {
+			delete(r.buckets, client)
+		}
+	}
+	if len(r.buckets) >= maxIdleBuckets {
+		delete(r.buckets, lru)
+	}
+}
+
+// rateLimiter holds the rules of WithRateLimit, which are fixed once the
+// server is created.
+type rateLimiter struct {
+	rules map[string]*rateRule // pattern -> rule
+}
+
+// allow takes a token for the call serviceMethod made with ctx from every
+// rule that matches it.
+func (l *rateLimiter) allow(ctx context.Context, serviceMethod string) error {
+	if l == nil {
+		return nil
+	}
+	patterns := []string{serviceMethod}
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		patterns = append(patterns, serviceMethod[:dot]+".*")
+	}
+	patterns = append(patterns, "*")
+
+	client := clientOf(ctx)
+	now := time.Now()
+	var taken []*rateRule
+	for _, p := range patterns {
+		r := l.rules[p]
+		if r == nil {
+			continue
+		}
+		if !r.take(client, now) {
+			for _, t := range taken {
+				t.giveBack(client)
+			}
+			return Errorf(ResourceExhausted, "rpc server: rate limit of %s exceeded", p)
+		}
+		taken = append(taken, r)
+	}
+	return nil
+}
+
+// clientOf returns the identity rate limits are kept per: the subject of the
+// caller, or the IP address of anonymous callers.
+func clientOf(ctx context.Context) string {
+	if subject := subjectOf(ctx); subject != "" {
+		return subject
+	}
+	if p, ok := PeerFromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// debugLimit is the state of a rule shown on the debug page.
+type debugLimit struct {
+	Pattern  string
+	Limit    Limit
+	Tokens   float64 // tokens left, for rules that are not PerClient
+	Clients  int     // callers with a bucket, for PerClient rules
+	Rejected uint64
+}
+
+func (l *rateLimiter) debug() []debugLimit {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	out := make([]debugLimit, 0, len(l.rules))
+	for _, r := range l.rules {
+		r.mu.Lock()
+		d := debugLimit{Pattern: r.pattern, Limit: r.limit, Rejected: r.rejected}
+		if r.limit.PerClient {
+			d.Clients = len(r.buckets)
+		} else if b := r.buckets[""]; b != nil {
+			b.refill(r.limit, now)
+			d.Tokens = b.tokens
+		} else {
+			d.Tokens = float64(r.limit.Burst)
+		}
+		r.mu.Unlock()
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pattern < out[j].Pattern })
+	return out
+}
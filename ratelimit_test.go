@@ -0,0 +1,64 @@
+package drpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_RateLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	server := NewServer(
+		WithAuthenticator(StaticTokens(map[string]string{"a": "alice", "b": "bob"})),
+		WithRateLimit("Whoami.Subject", Limit{Rate: 0.001, Burst: 2, PerClient: true}),
+		WithRateLimit("Whoami.*", Limit{Rate: 0.001, Burst: 3}),
+	)
+	_ = server.Register(Whoami{})
+	go server.Accept(l)
+	defer func() { _ = server.Close() }()
+
+	call := func(token string) error {
+		client, err := Dial("tcp", l.Addr().String(), &Option{PerRPCCredentials: BearerToken(token)})
+		assert(err == nil, "dial error: %v", err)
+		defer func() { _ = client.Close() }()
+		var subject string
+		return client.Call(context.Background(), "Whoami.Subject", 0, &subject)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = call("a")
+		assert(err == nil, "expect call %d to pass, got %v", i, err)
+	}
+	// alice 用完了自己的桶，bob 不受影响
+	err = call("a")
+	assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted, got %v", err)
+	err = call("b")
+	assert(err == nil, "expect bob to pass, got %v", err)
+	// 整个服务的桶也用完了
+	err = call("b")
+	assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted, got %v", err)
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	body := w.Body.String()
+	assert(strings.Contains(body, "Whoami.*") && strings.Contains(body, "2 clients"),
+		"expect the limiter state on the debug page, got %s", body)
+}
+
+func TestRateRule_MaxBuckets(t *testing.T) {
+	r := &rateRule{limit: Limit{Rate: 0.001, Burst: 2, PerClient: true}, buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	// 每个调用方都用掉一个令牌，桶都没有装满
+	for i := 0; i < 2*maxIdleBuckets; i++ {
+		assert(r.take(fmt.Sprint(i), now.Add(time.Duration(i))), "expect client %d to get a token", i)
+	}
+	assert(len(r.buckets) == maxIdleBuckets, "expect at most %d buckets, got %d", maxIdleBuckets, len(r.buckets))
+	_, recent := r.buckets[fmt.Sprint(2*maxIdleBuckets-1)]
+	_, old := r.buckets["0"]
+	assert(recent && !old, "expect the least recently used buckets to be dropped")
+}
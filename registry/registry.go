@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +19,7 @@ type DrpcRegistry struct {
 
 type ServerItem struct {
 	Addr      string
+	Weight    int // 0 if the server did not send one, see HeartbeatWeighted
 	startTime time.Time
 }
 
@@ -35,47 +37,100 @@ func New(timeout time.Duration) *DrpcRegistry {
 
 var DefaultDrpcRegister = New(defaultTimeOut)
 
-// putServers 添加服务实例，
-func (r *DrpcRegistry) putServer(addr string) {
+// putServers 添加服务实例，weight 为 0 表示服务没有设置权重
+func (r *DrpcRegistry) putServer(addr string, weight int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	server := r.servers[addr]
 	if server == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, startTime: time.Now()}
+		r.servers[addr] = &ServerItem{Addr: addr, Weight: weight, startTime: time.Now()}
 	} else {
+		server.Weight = weight
 		server.startTime = time.Now()
 	}
 }
 
-// aliveServers
-func (r *DrpcRegistry) aliveServers() []string {
+// removeServer 删除服务实例，服务下线时调用
+func (r *DrpcRegistry) removeServer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.servers, addr)
+}
+
+// aliveServers 返回没有过期的服务，以及其中设置了权重的服务的权重
+func (r *DrpcRegistry) aliveServers() ([]string, map[string]int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	var alive []string
+	weights := make(map[string]int)
 	for addr, s := range r.servers {
 		if r.timeout == 0 || s.startTime.Add(r.timeout).After(time.Now()) {
 			alive = append(alive, addr)
+			if s.Weight > 0 {
+				weights[addr] = s.Weight
+			}
 		} else {
 			delete(r.servers, addr)
 		}
 	}
 	sort.Strings(alive)
-	return alive
+	return alive, weights
+}
+
+// FormatWeights encodes weights for the X-Drpc-Weights header, as "addr=weight,...".
+func FormatWeights(weights map[string]int) string {
+	pairs := make([]string, 0, len(weights))
+	for addr, w := range weights {
+		pairs = append(pairs, addr+"="+strconv.Itoa(w))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ParseWeights decodes the X-Drpc-Weights header, skipping malformed entries.
+func ParseWeights(header string) map[string]int {
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(header, ",") {
+		// 地址中可能有 '='，以最后一个为准
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			continue
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(pair[i+1:]))
+		if err != nil || w <= 0 {
+			continue
+		}
+		weights[strings.TrimSpace(pair[:i])] = w
+	}
+	return weights
 }
 
 // run at /_drpc_/registry
 func (r *DrpcRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
-		w.Header().Set("X-Drpc-Servers", strings.Join(r.aliveServers(), ","))
+		alive, weights := r.aliveServers()
+		w.Header().Set("X-Drpc-Servers", strings.Join(alive, ","))
+		if len(weights) > 0 {
+			w.Header().Set("X-Drpc-Weights", FormatWeights(weights))
+		}
 	case http.MethodPost:
 		addr := req.Header.Get("X-Drpc-Server")
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		weight, _ := strconv.Atoi(req.Header.Get("X-Drpc-Weight"))
+		r.putServer(addr, weight)
 		log.Printf("rpc registry: putServer=%s, Numbers=%d\n", addr, len(r.servers))
+	case http.MethodDelete:
+		addr := req.Header.Get("X-Drpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.removeServer(addr)
+		log.Printf("rpc registry: removeServer=%s\n", addr)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -92,28 +147,63 @@ func HandleHTTP() {
 }
 
 // Heartbeat 提供 HeartBeat 方法，便于服务启动时定时向注册中心发送心跳，默认周期比注册中心设置过期的时间少1min
-func Heartbeat(registry, addr string, duration time.Duration) {
+// 返回的 stop 用于停止发送心跳，服务下线时先调用 stop 再调用 Deregister
+func Heartbeat(registry, addr string, duration time.Duration) (stop func()) {
+	return HeartbeatWeighted(registry, addr, 0, duration)
+}
+
+// HeartbeatWeighted is Heartbeat for a server with the given weight, which
+// discoveries pass on to weighted load balancing. 0 means no weight.
+func HeartbeatWeighted(registry, addr string, weight int, duration time.Duration) (stop func()) {
 	if duration == 0 {
 		// make sure there is enough time to send heart beat
 		// before it's removed from registry
 		duration = defaultTimeOut - time.Minute*time.Duration(1)
 	}
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(registry, addr, weight)
+	done := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
 		for err == nil {
-			<-ticker.C
-			err = sendHeartbeat(registry, addr)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			err = sendHeartbeat(registry, addr, weight)
 		}
 	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
 }
 
-func sendHeartbeat(registry, addr string) error {
+// Deregister removes addr from the registry right away,
+// instead of waiting for it to expire.
+func Deregister(registry, addr string) error {
+	log.Println(addr, "deregister from registry", registry)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodDelete, registry, nil)
+	req.Header.Set("X-Drpc-Server", addr)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("rpc server: deregister err: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+func sendHeartbeat(registry, addr string, weight int) error {
 	log.Println(addr, "send heart beat to registry", registry)
 	client := &http.Client{}
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, registry, nil)
 	req.Header.Set("X-Drpc-Server", addr)
+	if weight > 0 {
+		req.Header.Set("X-Drpc-Weight", strconv.Itoa(weight))
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
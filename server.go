@@ -1,6 +1,9 @@
 package drpc
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -30,11 +34,93 @@ const (
 // 在一次连接中，Option 固定在报文的最开始，Header 和 Body 可以有多个，即报文可能是这样的。
 // | Option | Header1 | Body1 | Header2 | Body2 | ...
 
+// 默认使用二进制分帧协议，Option 之前多了 MagicNumber 和版本号，之后每个 Header 和 Body
+// 都带有长度前缀，详见 handshake.go。上面的 JSON 握手仍然支持，用于兼容旧的客户端。
+
 type Option struct {
 	MagicNumber    int
 	CodecType      codec.Type
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+
+	// JSONHandshake makes the client use the legacy JSON handshake.
+	// It is also used when CodecType has no registered codec.Marshaler.
+	JSONHandshake bool
+
+	// StreamWindow is how many messages may be in flight on one stream before
+	// the receiver takes them, ConnWindow is the same for all the streams of the
+	// connection. They apply in both directions, 0 means the default, 64 and
+	// 1024, and they are capped at 1024 and 4096. A peer that sends beyond
+	// a window has the stream ended with ResourceExhausted, or the connection
+	// closed.
+	// The windows count messages, not bytes, and a message is always written
+	// whole, so a large message still delays the other calls of the connection
+	// while it is written; limit it with MaxSendMsgSize.
+	StreamWindow uint32
+	ConnWindow   uint32
+
+	// MaxRecvMsgSize and MaxSendMsgSize limit the size of the messages the
+	// client reads and writes, in bytes. 0 means 4MB, a negative value means
+	// no limit. With the legacy JSON
+	// handshake only MaxRecvMsgSize is enforced, and a larger message ends
+	// the connection instead of being skipped.
+	// The server has its own limits, see WithMaxRecvMsgSize.
+	MaxRecvMsgSize int `json:"-"`
+	MaxSendMsgSize int `json:"-"`
+
+	// TLSConfig is used by XDial for "tls@host:port" addresses, see DialTLS.
+	TLSConfig *tls.Config `json:"-"`
+
+	// Metadata is sent to the server with the handshake, see Authenticator.
+	Metadata Metadata `json:",omitempty"`
+	// PerRPCCredentials adds credentials to the handshake and to every call.
+	PerRPCCredentials PerRPCCredentials `json:"-"`
+}
+
+const (
+	defaultMaxRecvMsgSize = 4 << 20
+	defaultMaxSendMsgSize = 4 << 20
+)
+
+// setMsgSizeLimits applies the limits to cc if it supports them,
+// with the defaults described on Option.
+func setMsgSizeLimits(cc codec.Codec, recv, send int) {
+	l, ok := cc.(codec.SizeLimiter)
+	if !ok {
+		return
+	}
+	if recv == 0 {
+		recv = defaultMaxRecvMsgSize
+	}
+	if recv < 0 {
+		recv = 0
+	}
+	if send == 0 {
+		send = defaultMaxSendMsgSize
+	}
+	if send < 0 {
+		send = 0
+	}
+	l.SetMaxMsgSize(recv, send)
+}
+
+// windows returns the flow control windows of a connection made with opt.
+// Both sides call it on the same Option, so they agree on the limits.
+func (opt *Option) windows() (stream, conn uint32) {
+	stream, conn = opt.StreamWindow, opt.ConnWindow
+	if stream == 0 {
+		stream = defaultStreamWindow
+	}
+	if stream > maxStreamWindow {
+		stream = maxStreamWindow
+	}
+	if conn == 0 {
+		conn = defaultConnWindow
+	}
+	if conn > maxConnWindow {
+		conn = maxConnWindow
+	}
+	return
 }
 
 var DefaultOption = &Option{
@@ -46,10 +132,76 @@ var DefaultOption = &Option{
 // Server represents an RPC Server.
 type Server struct {
 	serviceMap sync.Map
+
+	mu           sync.Mutex
+	interceptors []ServerInterceptor
+	onPanic      PanicHandler
+	maxRequests  int // 每个连接上同时处理的请求数上限，0 表示不限制
+	maxRecvSize  int // 见 Option.MaxRecvMsgSize
+	maxSendSize  int
+	auth         Authenticator
+	authz        Authorizer
+	limits       *rateLimiter
+	load         *loadLimiter
+
+	// 以下字段用于 Shutdown 和 Close
+	inShutdown bool
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	onShutdown []func()
+}
+
+// ServerOption configures a Server created by NewServer.
+type ServerOption func(*Server)
+
+// PanicHandler is called with the recovered value and the stack
+// when a service method or an interceptor panics.
+type PanicHandler func(ctx context.Context, serviceMethod string, recovered interface{}, stack []byte)
+
+// WithPanicHandler sets the hook used to report recovered panics,
+// e.g. to an error tracker. Panics are logged either way.
+func WithPanicHandler(h PanicHandler) ServerOption {
+	return func(server *Server) {
+		server.onPanic = h
+	}
+}
+
+// WithMaxConcurrentRequests limits how many requests of one connection
+// are handled at the same time. Requests beyond the limit are rejected
+// with ResourceExhausted, so that one busy caller cannot starve the others.
+func WithMaxConcurrentRequests(n int) ServerOption {
+	return func(server *Server) {
+		server.maxRequests = n
+	}
+}
+
+// WithMaxRecvMsgSize limits the size of the requests and stream messages the
+// server reads, in bytes. Larger messages are skipped without being decoded and
+// the client gets ResourceExhausted. The default is 4MB, negative means no limit.
+// Clients of the legacy JSON handshake are disconnected instead, since their
+// messages cannot be skipped; the limit then also counts the Header.
+func WithMaxRecvMsgSize(n int) ServerOption {
+	return func(server *Server) {
+		server.maxRecvSize = n
+	}
 }
 
-func NewServer() *Server {
-	return &Server{}
+// WithMaxSendMsgSize limits the size of the replies the server writes, in bytes.
+// A larger reply is replaced by a ResourceExhausted error. The default is 4MB,
+// negative means no limit.
+// It is not enforced on connections that made the legacy JSON handshake.
+func WithMaxSendMsgSize(n int) ServerOption {
+	return func(server *Server) {
+		server.maxSendSize = n
+	}
+}
+
+func NewServer(opts ...ServerOption) *Server {
+	server := &Server{}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server
 }
 
 // DefaultServer is the default instance of *Server.
@@ -61,12 +213,32 @@ func Accept(lis net.Listener) {
 	DefaultServer.Accept(lis)
 }
 
+// Accept returns when lis is closed, e.g. by Shutdown or Close.
+// Other accept errors are logged and retried with a growing delay.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
+
+	var delay time.Duration
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if errors.Is(err, net.ErrClosed) || server.shuttingDown() {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("rpc server: accept error: %v; retrying in %v\n", err, delay)
+			time.Sleep(delay)
+			continue
 		}
+		delay = 0
 		go server.ServeConn(conn)
 	}
 }
@@ -87,49 +259,363 @@ func (server *Server) Register(rcvr interface{}) error {
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
 
+	peer, err := newPeer(conn)
+	if err != nil {
+		log.Println("rpc server: tls handshake error:", err)
+		return
+	}
+
+	// 握手阶段多读的字节留在 buf 中，之后交给 codec 继续读取
+	buf := bufio.NewReader(conn)
+	framed, err := isFramed(buf)
+	if err != nil {
+		log.Println("rpc server: read handshake error:", err)
+		return
+	}
+
+	var cc codec.Codec
+	var opt *Option
+	var info *AuthInfo
+	if framed {
+		cc, opt, info = server.framedHandshake(&bufferedConn{buf, conn}, peer)
+	} else {
+		cc, opt, info = server.jsonHandshake(buf, conn, peer)
+	}
+	if cc == nil {
+		return
+	}
+	server.serveCodec(cc, opt, peer, info)
+}
+
+// framedHandshake serves the binary handshake, see handshake.go.
+// It also authenticates the connection, see Authenticator.
+func (server *Server) framedHandshake(conn *bufferedConn, peer *Peer) (codec.Codec, *Option, *AuthInfo) {
+	opt, version, err := serverHandshake(conn)
+	if err != nil {
+		log.Println("rpc server: decode Option error:", err)
+		return nil, nil, nil
+	}
+
+	m, ok := codec.LookupMarshaler(opt.CodecType)
+	var reason error
+	var info *AuthInfo
+	switch {
+	case opt.MagicNumber != MagicNumber:
+		reason = fmt.Errorf("rpc server: invalid magic number %x", opt.MagicNumber)
+	case !ok:
+		reason = fmt.Errorf("rpc server: invalid codec type %s", opt.CodecType)
+	default:
+		info, reason = server.authenticateConn(peer, opt)
+	}
+	if err := acceptHandshake(conn, version, reason); err != nil {
+		log.Println("rpc server: write handshake error:", err)
+		return nil, nil, nil
+	}
+	if reason != nil {
+		log.Println(reason)
+		return nil, nil, nil
+	}
+	return codec.NewFrameCodec(conn, m), opt, info
+}
+
+// jsonHandshake serves the legacy handshake, in which the Option
+// is a bare JSON object followed by the codec's own stream.
+// There is no reply, so a rejected connection is simply closed.
+func (server *Server) jsonHandshake(buf *bufio.Reader, conn io.ReadWriteCloser, peer *Peer) (codec.Codec, *Option, *AuthInfo) {
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	// Option 之前没有长度，限制 json.Decoder 能读的字节数，与分帧握手的上限相同
+	dec := json.NewDecoder(io.LimitReader(buf, maxHandshakeFrame))
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc server: decode Option error:", err)
-		return
+		return nil, nil, nil
 	}
 	if opt.MagicNumber != MagicNumber {
 		log.Printf("rpc server: invalid magic number %x\n", opt.MagicNumber)
-		return
+		return nil, nil, nil
 	}
 
-	codecFunc := codec.NewCodecFuncMap[opt.CodecType]
-	if codecFunc == nil {
+	codecFunc, ok := codec.Lookup(opt.CodecType)
+	if !ok {
 		log.Printf("rpc server: invalid codec type %s\n", opt.CodecType)
+		return nil, nil, nil
+	}
+	info, err := server.authenticateConn(peer, &opt)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, nil
+	}
+	// json.Decoder 可能已经读走了 Option 之后的数据，需要先把它们还给 codec。
+	// json.Encoder 会在 Option 之后写一个换行符，它不属于 codec 的数据。json.Decoder 读到 '}'
+	// 就停止，换行符可能还在 buf 中，因此从两者拼接后的数据中丢弃一个开头的换行符。
+	rest := bufio.NewReader(io.MultiReader(dec.Buffered(), buf))
+	if b, err := rest.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = rest.Discard(1)
+	}
+	return newLegacyCodec(codecFunc, rest, conn), &opt, info
+}
+
+var invalidRequest = struct{}{}
+
+// serverConn 保存一个连接上所有请求共享的状态
+type serverConn struct {
+	cc      codec.Codec
+	sending sync.Mutex     // make sure to send a complete response
+	wg      sync.WaitGroup // wait until all request are handled
+	timeout time.Duration  // HandleTimeout of the connection
+	peer    *Peer          // the client, nil if unknown
+	auth    *AuthInfo      // set if the handshake authenticated the connection
+
+	// 流量控制，见 stream.go
+	streamWindow uint32
+	recvWindow   *recvWindow // 连接的接收窗口
+	quota        *sendQuota  // 连接的发送额度
+
+	mu        sync.Mutex
+	inflight  map[uint64]context.CancelFunc // 正在处理的请求，客户端取消时据此取消 ctx
+	streams   map[uint64]*serverStream      // 正在进行的流，KindStream 消息据此路由
+	active    int                           // 服务方法还没有返回的请求数
+	maxActive int                           // active 的上限，0 表示不限制
+	goingAway bool                          // GOAWAY 已发送，不再接收新的请求
+}
+
+// send writes a message that is not the response of a request.
+func (sc *serverConn) send(h *codec.Header, body interface{}) {
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	if err := sc.cc.Write(h, body); err != nil {
+		log.Println("rpc server: write message error:", err)
+	}
+}
+
+// openStream registers the stream of the streaming call seq.
+func (sc *serverConn) openStream(seq uint64) *serverStream {
+	s := &serverStream{
+		sc:    sc,
+		seq:   seq,
+		recv:  newRecvQueue(sc.streamWindow, sc.recvWindow),
+		quota: newSendQuota(sc.streamWindow),
+	}
+	s.raw, _ = sc.cc.(codec.RawReader)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.streams[seq] = s
+	return s
+}
+
+// closeStream unregisters the stream and gives back the connection
+// credit of the messages the method did not receive.
+func (sc *serverConn) closeStream(s *serverStream) {
+	sc.mu.Lock()
+	delete(sc.streams, s.seq)
+	sc.mu.Unlock()
+	sc.sendWindowUpdate(0, windowUpdate{conn: s.recv.release()})
+}
+
+// routeStream hands a message received on a stream to the stream.
+// Messages of streams that have already ended are dropped.
+func (sc *serverConn) routeStream(h *codec.Header, data []byte) {
+	if h.Kind == codec.KindWindowUpdate && h.Seq == 0 {
+		sc.quota.add(h.Window)
 		return
 	}
+	sc.mu.Lock()
+	s := sc.streams[h.Seq]
+	sc.mu.Unlock()
+	switch {
+	case s == nil:
+		if h.Kind == codec.KindStream && !h.EndStream {
+			sc.dropped()
+		}
+	case h.Kind == codec.KindWindowUpdate:
+		s.quota.add(h.Window)
+	case h.EndStream:
+		s.recv.finish(nil)
+	case !s.recv.win.receive():
+		// 客户端超出了流的窗口，结束这个流，消息被丢弃
+		s.recv.finish(Errorf(ResourceExhausted, "rpc server: stream window exceeded"))
+		sc.dropped()
+	default:
+		if !s.recv.push(data) {
+			sc.dropped()
+		}
+	}
+}
 
-	cc := codecFunc(conn)
-	server.ServeCodec(cc, opt.HandleTimeout)
+// dropped gives back the connection credit of a stream message nobody will
+// receive. It runs on the reading goroutine, so it must not block on sending.
+func (sc *serverConn) dropped() {
+	if n := sc.recvWindow.consume(1); n > 0 {
+		go sc.sendWindowUpdate(0, windowUpdate{conn: n})
+	}
 }
 
-var invalidRequest = struct{}{}
+// failStream ends the receiving side of the stream seq with err,
+// e.g. when a message on it was too large to be read.
+func (sc *serverConn) failStream(seq uint64, err error) {
+	sc.mu.Lock()
+	s := sc.streams[seq]
+	sc.mu.Unlock()
+	if s != nil {
+		s.recv.finish(err)
+	}
+	// 被跳过的消息同样占用了连接的额度
+	sc.dropped()
+}
+
+// sendWindowUpdate gives the credit in update back to the client.
+func (sc *serverConn) sendWindowUpdate(seq uint64, update windowUpdate) {
+	if update.stream > 0 {
+		sc.send(&codec.Header{Seq: seq, Kind: codec.KindWindowUpdate, Window: update.stream}, invalidRequest)
+	}
+	if update.conn > 0 {
+		sc.send(&codec.Header{Kind: codec.KindWindowUpdate, Window: update.conn}, invalidRequest)
+	}
+}
+
+// admit adds a request to wg unless the connection is going away or
+// already handles maxActive requests.
+// wg.Add must not race with the wg.Wait in Shutdown, hence the lock.
+func (sc *serverConn) admit() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.goingAway {
+		return errServerShutdown
+	}
+	if sc.maxActive > 0 && sc.active >= sc.maxActive {
+		return Errorf(ResourceExhausted, "rpc server: too many concurrent requests on the connection, limit %d", sc.maxActive)
+	}
+	sc.active++
+	sc.wg.Add(1)
+	return nil
+}
 
+// release is called once the method of an admitted request has returned.
+func (sc *serverConn) release() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active--
+}
+
+// track records the cancel func of an in-flight request.
+func (sc *serverConn) track(seq uint64, cancel context.CancelFunc) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.inflight[seq] = cancel
+}
+
+func (sc *serverConn) untrack(seq uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.inflight, seq)
+}
+
+// cancel cancels the context of the in-flight request seq, if any.
+func (sc *serverConn) cancel(seq uint64) {
+	sc.mu.Lock()
+	cancel := sc.inflight[seq]
+	sc.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// abort closes a connection whose client broke the protocol,
+// and ends the requests and streams in flight on it with err.
+func (sc *serverConn) abort(err error) {
+	_ = sc.cc.Close()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, cancel := range sc.inflight {
+		cancel()
+	}
+	for _, s := range sc.streams {
+		s.recv.finish(err)
+	}
+}
+
+// ServeCodec serves the requests read from cc with the given HandleTimeout
+// and the default flow control windows.
 func (server *Server) ServeCodec(cc codec.Codec, timeout time.Duration) {
-	// var sending *sync.Mutex // make sure to send a complete response
-	// var wg *sync.WaitGroup
+	server.serveCodec(cc, &Option{HandleTimeout: timeout}, nil, nil)
+}
+
+// serveCodec serves cc with the options the client sent in the handshake.
+// peer is the client, nil if unknown, and info is set if the handshake
+// authenticated the connection.
+func (server *Server) serveCodec(cc codec.Codec, opt *Option, peer *Peer, info *AuthInfo) {
+	setMsgSizeLimits(cc, server.maxRecvSize, server.maxSendSize)
+	streamWindow, connWindow := opt.windows()
+	sc := &serverConn{
+		cc:           cc,
+		timeout:      opt.HandleTimeout,
+		peer:         peer,
+		auth:         info,
+		streamWindow: streamWindow,
+		recvWindow:   newRecvWindow(connWindow),
+		quota:        newSendQuota(connWindow),
+		inflight:     make(map[uint64]context.CancelFunc),
+		streams:      make(map[uint64]*serverStream),
+		maxActive:    server.maxRequests,
+	}
+	if !server.trackConn(sc, true) {
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(sc, false)
 
-	// 不能使用上面的，因为这样传参会传输nil ！！！！本函数直接使用的话是延迟初始化，没有问题。
-	sending := new(sync.Mutex) // make sure to send a complete response
-	wg := new(sync.WaitGroup)  // wait until all request are handled
 	for {
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(sc)
+		if req != nil && req.h.Kind == codec.KindStream && !req.h.EndStream && !sc.recvWindow.receive() {
+			// 客户端超出了连接的窗口，不再信任它
+			log.Println("rpc server: connection window exceeded")
+			sc.abort(Errorf(ResourceExhausted, "rpc server: connection window exceeded"))
+			break
+		}
 		if err != nil {
 			if req == nil {
 				break
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			if req.h.Kind == codec.KindStream {
+				sc.failStream(req.h.Seq, err)
+				continue
+			}
+			setHeaderStatus(req.h, err)
+			req.h.Metadata = nil
+			server.sendResponse(cc, req.h, invalidRequest, &sc.sending)
+			continue
+		}
+		switch req.h.Kind {
+		case codec.KindCancel:
+			sc.cancel(req.h.Seq)
+			continue
+		case codec.KindStream, codec.KindWindowUpdate:
+			sc.routeStream(req.h, req.data)
+			continue
+		}
+		err = sc.admit()
+		if err == nil {
+			if req.slot, err = server.load.reserve(req.h.ServiceMethod, req.mTyp.streaming()); err != nil {
+				sc.release()
+				sc.wg.Done()
+			}
+		}
+		if err != nil {
+			// 与 GOAWAY 同时到达的请求，或者超出了并发上限
+			setHeaderStatus(req.h, err)
+			req.h.Metadata = nil
+			server.sendResponse(cc, req.h, invalidRequest, &sc.sending)
 			continue
 		}
-		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, timeout)
+		if req.mTyp.streaming() {
+			// 在读取下一条消息之前注册，保证紧随其后的流消息能找到它
+			req.stream = sc.openStream(req.h.Seq)
+		}
+		// 在读取下一条消息之前登记，保证紧随其后的 KindCancel 能找到这个请求
+		req.ctx, req.cancel = context.WithCancel(req.ctx)
+		sc.track(req.h.Seq, req.cancel)
+		go server.handleRequest(sc, req)
 	}
-	wg.Wait()
+	sc.wg.Wait()
 	_ = cc.Close()
 }
 
@@ -137,24 +623,67 @@ type request struct {
 	h      *codec.Header // header of request
 	argv   reflect.Value
 	replyv reflect.Value
+	data   []byte        // undecoded body of a KindStream message
+	stream *serverStream // stream of a streaming call
+
+	ctx    context.Context // carries the Peer, the incoming Metadata and the AuthInfo
+	cancel context.CancelFunc
+	tr     *trailer
+	slot   *loadSlot // place of the request in the load limits, see load.go
 
 	mTyp   *methodType
 	servci *service
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+func (server *Server) readRequest(sc *serverConn) (*request, error) {
+	cc := sc.cc
 	header, err := server.readRequestHeader(cc)
 	if err != nil {
 		return nil, err
 	}
 
 	req := &request{h: header}
+	switch header.Kind {
+	case codec.KindCancel, codec.KindWindowUpdate:
+		return req, cc.ReadBody(nil)
+	case codec.KindStream:
+		raw, ok := cc.(codec.RawReader)
+		if !ok || header.EndStream {
+			return req, cc.ReadBody(nil)
+		}
+		if req.data, err = raw.ReadRawBody(); err != nil {
+			if isMsgSizeError(err) {
+				// 消息已经被跳过，连接仍然可用，交给 ServeCodec 结束这个流
+				return req, StatusOf(err)
+			}
+			return nil, err
+		}
+		return req, nil
+	}
+	// 先认证和鉴权再查找方法，被拒绝的调用方无法探测哪些方法存在，body 也不会被解码
+	if req.ctx, req.tr, err = server.requestContext(sc, header); err != nil {
+		_ = cc.ReadBody(nil)
+		return req, err
+	}
 	req.servci, req.mTyp, err = server.findService(header.ServiceMethod)
 	if err != nil {
+		// 丢弃 body，否则它会被当作下一个请求的 header
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
+	if req.mTyp.bidi {
+		// 双向流的参数随后通过 KindStream 消息到达
+		if _, ok := cc.(codec.RawReader); !ok {
+			_ = cc.ReadBody(nil)
+			return req, Errorf(Unimplemented, "rpc server: codec does not support streaming")
+		}
+		return req, cc.ReadBody(nil)
+	}
 	req.argv = req.mTyp.newArgv()
-	req.replyv = req.mTyp.newRetv()
+	if !req.mTyp.stream {
+		// 流式方法的 replyv 是 ServerStream，在 handleRequest 中创建
+		req.replyv = req.mTyp.newRetv()
+	}
 
 	// make sure that argvi is a pointer interface{},
 	// because ReadBody needs a pointer as parameter
@@ -165,7 +694,10 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 
 	if err = cc.ReadBody(argvInter); err != nil {
 		log.Println("rpc server: read body error:", err)
-		return req, err
+		if isMsgSizeError(err) {
+			return req, StatusOf(err)
+		}
+		return req, Errorf(InvalidArgument, "rpc server: read body error: %v", err)
 	}
 	return req, nil
 }
@@ -181,24 +713,48 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	return &h, nil
 }
 
+// requestContext returns the context the request h is handled with.
+// It authenticates, authorizes and rate limits the caller,
+// see Authenticator, Authorizer and WithRateLimit.
+func (server *Server) requestContext(sc *serverConn, h *codec.Header) (context.Context, *trailer, error) {
+	// 请求的 Metadata 交给 ctx，响应的 Header 只携带 SetTrailer 设置的 trailer
+	ctx := context.Background()
+	if sc.peer != nil {
+		ctx = context.WithValue(ctx, peerKey{}, sc.peer)
+	}
+	ctx, tr := newIncomingContext(ctx, h.Metadata)
+	h.Metadata = nil
+	ctx, err := server.authenticate(ctx, sc, h.ServiceMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = server.authorize(ctx, h.ServiceMethod); err != nil {
+		return nil, nil, err
+	}
+	if err = server.limits.allow(ctx, h.ServiceMethod); err != nil {
+		return nil, nil, err
+	}
+	return ctx, tr, nil
+}
+
 func (server *Server) findService(serviceMethod string) (servci *service, mTyp *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request illegal-formed: " + serviceMethod)
+		err = Errorf(InvalidArgument, "rpc server: service/method request illegal-formed: %s", serviceMethod)
 		return
 	}
 
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	serviceInter, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service: " + serviceName)
+		err = Errorf(NotFound, "rpc server: can't find service: %s", serviceName)
 		return
 	}
 
 	servci = serviceInter.(*service)
 	mTyp = servci.method[methodName]
 	if mTyp == nil {
-		err = errors.New("rpc server: can't find method: " + methodName)
+		err = Errorf(NotFound, "rpc server: can't find method: %s", methodName)
 		return
 	}
 	return
@@ -207,47 +763,151 @@ func (server *Server) findService(serviceMethod string) (servci *service, mTyp *
 // 这里需要确保 sendResponse 仅调用一次，因此将整个过程拆分为 called 和 sent 两个阶段，
 // 在这段代码中只会发生如下两种情况：
 // 1) called 信道接收到消息，代表处理没有超时，继续执行 sendResponse。
-// 2) time.After() 先于 called 接收到消息，说明处理已经超时，called 和 sent 都将被阻塞。
-//    在 case <-time.After(timeout) 处调用 sendResponse。
-func (server *Server) handleRequest(cc codec.Codec, req *request,
-	sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
+// 2) 超时先于 called 发生，在超时的 case 处回复错误。方法之后仍会返回，called 和 sent
+// 带有缓冲，处理方法的 goroutine 不会阻塞，respond 保证它不会再回复一次。
+// 超时有两个来源：连接级别的 HandleTimeout，以及客户端通过 Header.Timeout 传来的 deadline。
+// 任何一个到期都会取消传给服务方法的 ctx。
+// 客户端发来 KindCancel 时 ctx 同样会被取消，此时客户端已经不再等待，不需要回复。
+func (server *Server) handleRequest(sc *serverConn, req *request) {
+	defer sc.wg.Done()
+
+	ctx, cancel := req.ctx, req.cancel
+	defer cancel()
+	defer sc.untrack(req.h.Seq)
+	if req.h.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, req.h.Timeout)
+		defer cancelTimeout()
+	}
 
-	called, sent := make(chan struct{}), make(chan struct{})
+	if req.stream != nil {
+		defer sc.closeStream(req.stream)
+		req.stream.ctx = ctx
+		req.replyv = reflect.ValueOf(req.stream)
+	}
+	if err := req.slot.acquire(ctx); err != nil {
+		sc.release()
+		if ctx.Err() != context.Canceled {
+			// 被客户端取消的请求没有人等待回复
+			setHeaderStatus(req.h, err)
+			server.sendResponse(sc.cc, req.h, invalidRequest, &sc.sending)
+		}
+		return
+	}
+
+	// 超时之后方法仍会返回，respond 保证每个请求只回复一次
+	var once sync.Once
+	respond := func(err error, body interface{}, md Metadata) {
+		once.Do(func() {
+			req.h.Metadata = md
+			if err != nil {
+				setHeaderStatus(req.h, err)
+				body = invalidRequest
+			}
+			server.sendResponse(sc.cc, req.h, body, &sc.sending)
+		})
+	}
+
+	// 带缓冲，超时返回之后处理方法的 goroutine 不会阻塞在这里
+	called, sent := make(chan struct{}, 1), make(chan struct{}, 1)
 	go func() {
-		err := req.servci.call(req.mTyp, req.argv, req.replyv)
+		err := server.invoke(ctx, req)
+		req.slot.release()
+		sc.release()
 		called <- struct{}{}
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
-			return
+		if ctx.Err() != context.Canceled {
+			reply := req.replyv.Interface()
+			if req.stream != nil {
+				// 流式方法的回复已经通过 stream 发送，这里只结束流
+				reply = invalidRequest
+			}
+			respond(err, reply, req.tr.metadata())
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
 		sent <- struct{}{}
 	}()
 
 	// block if HandleTimeout is equal with zero
-	if timeout == 0 {
-		<-called
-		<-sent
+	var handleTimeout <-chan time.Time
+	if sc.timeout > 0 {
+		handleTimeout = time.After(sc.timeout)
 	}
 
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
+	case <-handleTimeout:
+		cancel()
+		respond(Errorf(DeadlineExceeded,
+			"rpc server: request handle timeout: expect within %s", sc.timeout), nil, nil)
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			// canceled by the client, wait for the method to return
+			<-called
+			<-sent
+			return
+		}
+		respond(Errorf(DeadlineExceeded,
+			"rpc server: request deadline exceeded: %v", ctx.Err()), nil, nil)
 	case <-called:
 		<-sent
 	}
 }
 
+// invoke calls the service method of req through the interceptor chain.
+// 服务方法的 panic 由 service.call 恢复，拦截器的 panic 在这里恢复，
+// 两者都会变成 Internal 错误返回给客户端，不会影响其他请求。
+func (server *Server) invoke(ctx context.Context, req *request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = server.recovered(ctx, req.h.ServiceMethod, &panicError{value: r, stack: debug.Stack()})
+		}
+	}()
+
+	// 拦截器可能替换了参数、回复或者方法，最内层的 Handler 使用传下来的值
+	h := server.chain(func(ctx context.Context, serviceMethod string, argv, replyv interface{}) error {
+		servci, mTyp := req.servci, req.mTyp
+		if serviceMethod != req.h.ServiceMethod {
+			var err error
+			if servci, mTyp, err = server.findService(serviceMethod); err != nil {
+				return err
+			}
+		}
+		argV, replyV := reflect.ValueOf(argv), reflect.ValueOf(replyv)
+		if !mTyp.accepts(argV, replyV) {
+			return Errorf(InvalidArgument, "rpc server: %s: argv or replyv of wrong type", serviceMethod)
+		}
+		err := servci.call(ctx, mTyp, argV, replyV)
+		if pe, ok := err.(*panicError); ok {
+			return server.recovered(ctx, serviceMethod, pe)
+		}
+		return err
+	})
+	var argv interface{}
+	if req.argv.IsValid() {
+		argv = req.argv.Interface()
+	}
+	return h(ctx, req.h.ServiceMethod, argv, req.replyv.Interface())
+}
+
+// recovered reports a recovered panic and returns the error sent to the client.
+func (server *Server) recovered(ctx context.Context, serviceMethod string, pe *panicError) error {
+	log.Printf("rpc server: %s panic: %v\n%s", serviceMethod, pe.value, pe.stack)
+	if server.onPanic != nil {
+		server.onPanic(ctx, serviceMethod, pe.value, pe.stack)
+	}
+	return Errorf(Internal, "rpc server: %s panic: %v", serviceMethod, pe.value)
+}
+
 func (server *Server) sendResponse(cc codec.Codec, h *codec.Header,
 	body interface{}, sending *sync.Mutex) {
 	// TODO: 并发问题，保证发送过程是原子的
 	sending.Lock()
 	defer sending.Unlock()
-	if err := cc.Write(h, body); err != nil {
+	err := cc.Write(h, body)
+	if isMsgSizeError(err) {
+		// 回复过大时没有写入任何数据，改为回复错误
+		setHeaderStatus(h, err)
+		err = cc.Write(h, invalidRequest)
+	}
+	if err != nil {
 		log.Println("rpc server: write response error:", err)
 	}
 }
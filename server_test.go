@@ -0,0 +1,652 @@
+package drpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devhg/drpc/codec"
+	"github.com/devhg/drpc/registry"
+)
+
+// startTestServer serves server on a free port and returns a connected client.
+func startTestServer(t *testing.T, server *Server, opts ...*Option) *Client {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), opts...)
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = l.Close()
+	})
+	return client
+}
+
+func TestServer_Use(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+
+	var trace []string
+	server.Use(func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error {
+		trace = append(trace, "outer:"+serviceMethod)
+		return next(ctx, serviceMethod, argv, replyv)
+	}, func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error {
+		trace = append(trace, "inner")
+		if args := argv.(Args); args.Num1 < 0 {
+			return errors.New("negative numbers are not allowed")
+		}
+		err := next(ctx, serviceMethod, argv, replyv)
+		*replyv.(*int) *= 10
+		return err
+	})
+	client := startTestServer(t, server)
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	assert(err == nil && reply == 30, "expect reply modified by interceptor, got %d: %v", reply, err)
+	assert(strings.Join(trace, ",") == "outer:Foo.Sum,inner", "unexpected interceptor order: %v", trace)
+
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: -1, Num2: 2}, &reply)
+	assert(err != nil && strings.Contains(err.Error(), "negative numbers"), "expect short-circuit error, got %v", err)
+}
+
+func TestServer_UseReplaceArgs(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.Use(func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error {
+		switch args := argv.(Args); {
+		case args.Num1 < 0:
+			// 替换成类型不符的参数
+			return next(ctx, serviceMethod, &args, replyv)
+		case args.Num1 == 0:
+			return next(ctx, serviceMethod, Args{Num1: 10, Num2: args.Num2}, replyv)
+		}
+		return next(ctx, serviceMethod, argv, replyv)
+	})
+	client := startTestServer(t, server)
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 0, Num2: 2}, &reply)
+	assert(err == nil && reply == 12, "expect the args replaced by the interceptor, got %d: %v", reply, err)
+
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: -1, Num2: 2}, &reply)
+	assert(CodeOf(err) == InvalidArgument, "expect args of the wrong type to be refused, got %v", err)
+}
+
+type Waiter struct {
+	canceled chan error
+}
+
+func (w *Waiter) Wait(ctx context.Context, d time.Duration, reply *int) error {
+	select {
+	case <-ctx.Done():
+		w.canceled <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func TestServer_ContextDeadline(t *testing.T) {
+	server := NewServer()
+	w := &Waiter{canceled: make(chan error, 1)}
+	_ = server.Register(w)
+	client := startTestServer(t, server)
+
+	var reply int
+	err := client.Call(context.Background(), "Waiter.Wait", time.Millisecond, &reply)
+	assert(err == nil, "expect call without deadline to succeed: %v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = client.Call(ctx, "Waiter.Wait", 10*time.Second, &reply)
+	assert(err != nil, "expect a timeout error")
+
+	select {
+	case err := <-w.canceled:
+		assert(err == context.DeadlineExceeded, "expect deadline exceeded, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect handler context to be canceled by the client deadline")
+	}
+}
+
+func TestServer_TimeoutNoLeak(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Waiter{canceled: make(chan error, 20)})
+	client := startTestServer(t, server, &Option{HandleTimeout: 10 * time.Millisecond})
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		err := client.Call(context.Background(), "Waiter.Wait", time.Second, new(int))
+		assert(CodeOf(err) == DeadlineExceeded, "expect the handle timeout, got %v", err)
+	}
+	// 方法在 ctx 取消后返回，处理它的 goroutine 随之退出
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(runtime.NumGoroutine() <= before, "expect no goroutine left behind, %d before and %d after",
+		before, runtime.NumGoroutine())
+}
+
+func TestServer_CancelCall(t *testing.T) {
+	server := NewServer()
+	w := &Waiter{canceled: make(chan error, 1)}
+	_ = server.Register(w)
+	client := startTestServer(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var reply int
+	err := client.Call(ctx, "Waiter.Wait", 10*time.Second, &reply)
+	assert(err != nil && strings.Contains(err.Error(), "canceled"), "expect a canceled error, got %v", err)
+
+	select {
+	case err := <-w.canceled:
+		assert(err == context.Canceled, "expect canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect handler context to be canceled by the client")
+	}
+
+	// the connection is still usable after a cancellation
+	err = client.Call(context.Background(), "Waiter.Wait", time.Millisecond, &reply)
+	assert(err == nil, "expect call to succeed: %v", err)
+}
+
+func TestServer_CancelRightAfterCall(t *testing.T) {
+	server := NewServer()
+	w := &Waiter{canceled: make(chan error, 1)}
+	_ = server.Register(w)
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(codec.NewGobCodec(serverConn), 0)
+	cc := codec.NewGobCodec(clientConn)
+	defer func() { _ = cc.Close() }()
+
+	// KindCancel 紧跟在请求之后，读循环处理它时请求可能还没有开始处理
+	go func() {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Waiter.Wait", Seq: 1}, 10*time.Second)
+		_ = cc.Write(&codec.Header{Seq: 1, Kind: codec.KindCancel}, struct{}{})
+	}()
+	select {
+	case err := <-w.canceled:
+		assert(err == context.Canceled, "expect canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the cancel not to be lost")
+	}
+}
+
+type Tenant struct{}
+
+func (Tenant) Whoami(ctx context.Context, _ int, reply *string) error {
+	md, _ := FromIncomingContext(ctx)
+	*reply = md["tenant"]
+	return SetTrailer(ctx, Pairs("served-by", "tenant-service"))
+}
+
+func TestServer_Metadata(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(Tenant{})
+	client := startTestServer(t, server)
+
+	var reply string
+	var trailer Metadata
+	ctx := AppendToOutgoingContext(context.Background(), "tenant", "acme")
+	ctx = WithTrailer(ctx, &trailer)
+	err := client.Call(ctx, "Tenant.Whoami", 0, &reply)
+	assert(err == nil && reply == "acme", "expect tenant from metadata, got %q: %v", reply, err)
+	assert(trailer["served-by"] == "tenant-service", "unexpected trailer %v", trailer)
+	_, ok := trailer["tenant"]
+	assert(!ok, "request metadata must not be echoed in the trailer")
+}
+
+func (Tenant) Reject(_ int, _ *string) error {
+	return &Status{Code: PermissionDenied, Message: "tenant is suspended", Details: []string{"acme"}}
+}
+
+func TestServer_Status(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(Tenant{})
+	client := startTestServer(t, server)
+
+	var reply string
+	var s *Status
+	err := client.Call(context.Background(), "Tenant.Missing", 0, &reply)
+	assert(errors.As(err, &s) && s.Code == NotFound, "expect NotFound, got %v", err)
+
+	err = client.Call(context.Background(), "Tenant.Reject", 0, &reply)
+	assert(errors.As(err, &s) && s.Code == PermissionDenied && s.Message == "tenant is suspended" &&
+		len(s.Details) == 1 && s.Details[0] == "acme", "expect the status returned by the method, got %#v", s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = server.Register(&Waiter{canceled: make(chan error, 1)})
+	err = client.Call(ctx, "Waiter.Wait", time.Second, new(int))
+	assert(CodeOf(err) == DeadlineExceeded, "expect DeadlineExceeded, got %v", err)
+	assert(CodeOf(errors.New("plain")) == Unknown && CodeOf(nil) == OK, "unexpected codes of plain errors")
+}
+
+func (Tenant) Crash(_ int, reply *string) error {
+	var m map[string]string
+	m["boom"] = *reply // nil map write
+	return nil
+}
+
+func TestServer_PanicRecovery(t *testing.T) {
+	reported := make(chan string, 1)
+	server := NewServer(WithPanicHandler(func(ctx context.Context, serviceMethod string, recovered interface{}, stack []byte) {
+		reported <- serviceMethod
+	}))
+	_ = server.Register(Tenant{})
+	client := startTestServer(t, server)
+
+	var reply string
+	err := client.Call(context.Background(), "Tenant.Crash", 0, &reply)
+	assert(CodeOf(err) == Internal, "expect Internal, got %v", err)
+	select {
+	case method := <-reported:
+		assert(method == "Tenant.Crash", "unexpected panic report for %s", method)
+	case <-time.After(time.Second):
+		t.Fatal("expect the panic handler to be called")
+	}
+
+	// the server keeps serving other requests
+	err = client.Call(AppendToOutgoingContext(context.Background(), "tenant", "acme"), "Tenant.Whoami", 0, &reply)
+	assert(err == nil && reply == "acme", "expect server to survive the panic: %v", err)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	reg := httptest.NewServer(registry.New(0))
+	defer reg.Close()
+
+	server := NewServer()
+	_ = server.Register(&Waiter{canceled: make(chan error, 1)})
+	server.Heartbeat(reg.URL, "tcp@drain-test", 0)
+	client := startTestServer(t, server)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call(context.Background(), "Waiter.Wait", 300*time.Millisecond, new(int))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	assert(err == nil, "expect graceful shutdown, got %v", err)
+	assert(<-done == nil, "expect the in-flight call to complete")
+	assert(client.GoingAway() && !client.IsAvailable(), "expect the client to have received GOAWAY")
+
+	err = client.Call(context.Background(), "Waiter.Wait", time.Millisecond, new(int))
+	assert(err == ErrShutdown, "expect new calls to be refused, got %v", err)
+
+	resp, err := http.Get(reg.URL)
+	assert(err == nil && resp.Header.Get("X-Drpc-Servers") == "", "expect the server to be deregistered")
+	_ = resp.Body.Close()
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Waiter{canceled: make(chan error, 1)})
+	client := startTestServer(t, server)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call(context.Background(), "Waiter.Wait", 10*time.Second, new(int))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	assert(err == context.DeadlineExceeded, "expect shutdown to time out, got %v", err)
+	assert(<-done != nil, "expect the in-flight call to fail after a forced close")
+}
+
+type Counter struct{}
+
+// Count sends 1..n, then fails if n is negative.
+func (Counter) Count(n int, stream ServerStream) error {
+	if n < 0 {
+		return Errorf(InvalidArgument, "negative count %d", n)
+	}
+	for i := 1; i <= n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return SetTrailer(stream.Context(), Pairs("sent", fmt.Sprint(n)))
+}
+
+func TestServer_Stream(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = server.Register(Counter{})
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JSONType} {
+		client := startTestServer(t, server, &Option{CodecType: typ})
+		t.Run(string(typ), func(t *testing.T) {
+			stream, err := client.Stream(context.Background(), "Counter.Count", 5)
+			assert(err == nil, "stream error: %v", err)
+			var got []int
+			for {
+				var n int
+				if err = stream.Recv(&n); err != nil {
+					break
+				}
+				got = append(got, n)
+			}
+			assert(err == io.EOF, "expect io.EOF at the end of the stream, got %v", err)
+			assert(fmt.Sprint(got) == "[1 2 3 4 5]", "unexpected replies %v", got)
+			assert(stream.Trailer()["sent"] == "5", "unexpected trailer %v", stream.Trailer())
+
+			stream, _ = client.Stream(context.Background(), "Counter.Count", -1)
+			err = stream.Recv(new(int))
+			assert(CodeOf(err) == InvalidArgument, "expect the method error, got %v", err)
+
+			// the connection is still usable for plain calls after streams
+			var reply int
+			err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+			assert(err == nil && reply == 3, "call after stream failed: %v", err)
+		})
+	}
+}
+
+// Sum adds up the numbers the client sends and replies once.
+func (Counter) Sum(stream Stream) error {
+	var sum int
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return stream.Send(sum)
+		}
+		if err != nil {
+			return err
+		}
+		sum += n
+	}
+}
+
+// Echo replies to each number with its double.
+func (Counter) Echo(stream Stream) error {
+	for {
+		var n int
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := stream.Send(2 * n); err != nil {
+			return err
+		}
+	}
+}
+
+// Hold never reads what the client sends.
+func (Counter) Hold(stream Stream) error {
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestServer_ClientStream(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(Counter{})
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JSONType} {
+		client := startTestServer(t, server, &Option{CodecType: typ})
+		t.Run(string(typ), func(t *testing.T) {
+			stream, err := client.NewStream(context.Background(), "Counter.Sum")
+			assert(err == nil, "stream error: %v", err)
+			want := 0
+			for i := 1; i <= 3*defaultStreamWindow; i++ {
+				assert(stream.Send(i) == nil, "send %d failed", i)
+				want += i
+			}
+			var sum int
+			err = stream.CloseAndRecv(&sum)
+			assert(err == nil && sum == want, "expect sum %d, got %d: %v", want, sum, err)
+		})
+	}
+}
+
+func TestServer_BidiStream(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(Counter{})
+	client := startTestServer(t, server)
+
+	stream, err := client.NewStream(context.Background(), "Counter.Echo")
+	assert(err == nil, "stream error: %v", err)
+	const n = 5 * defaultStreamWindow
+	go func() {
+		for i := 0; i < n; i++ {
+			if stream.Send(i) != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+	for i := 0; ; i++ {
+		var reply int
+		if err = stream.Recv(&reply); err != nil {
+			assert(i == n, "expect %d replies, got %d", n, i)
+			break
+		}
+		assert(reply == 2*i, "expect %d, got %d", 2*i, reply)
+	}
+	assert(err == io.EOF, "expect io.EOF, got %v", err)
+
+	// a receiver that does not read stops the sender once the window is used up
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	stream, _ = client.NewStream(ctx, "Counter.Hold")
+	for i := 0; i < defaultStreamWindow; i++ {
+		assert(stream.Send(i) == nil, "send %d within the window failed", i)
+	}
+	err = stream.Send(0)
+	assert(CodeOf(err) == DeadlineExceeded, "expect send to block until the deadline, got %v", err)
+}
+
+// Hold waits for the stream to be canceled.
+func (w *Waiter) Hold(stream Stream) error {
+	<-stream.Context().Done()
+	w.canceled <- stream.Context().Err()
+	return nil
+}
+
+func TestServer_StreamCancel(t *testing.T) {
+	server := NewServer()
+	w := &Waiter{canceled: make(chan error, 1)}
+	_ = server.Register(w)
+	client := startTestServer(t, server)
+
+	// the stream is canceled with its context, without a pending Send or Recv
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.NewStream(ctx, "Waiter.Hold")
+	assert(err == nil, "stream error: %v", err)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-w.canceled:
+		assert(err == context.Canceled, "expect the server to see the cancellation, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the server stream to be canceled")
+	}
+	err = stream.Recv(new(int))
+	assert(CodeOf(err) == Canceled, "expect Recv to report the cancellation, got %v", err)
+}
+
+func TestServer_ConnWindow(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(Counter{})
+	client := startTestServer(t, server, &Option{StreamWindow: 4, ConnWindow: 6})
+
+	first, _ := client.NewStream(context.Background(), "Counter.Hold")
+	for i := 0; i < 4; i++ {
+		assert(first.Send(i) == nil, "send %d within the stream window failed", i)
+	}
+
+	second, _ := client.NewStream(context.Background(), "Counter.Hold")
+	for i := 0; i < 2; i++ {
+		assert(second.Send(i) == nil, "send %d within the connection window failed", i)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- second.Send(2) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("expect send beyond the connection window to block, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the server gives back the credit of the messages the first stream never read
+	_ = first.Close()
+	select {
+	case err := <-sent:
+		assert(err == nil, "expect send to resume, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the connection window to be given back")
+	}
+	_ = second.Close()
+}
+
+// Drain holds the messages of a stream until open is closed, then receives them all.
+func (g *Gate) Drain(stream Stream) error {
+	<-g.open
+	for {
+		if err := stream.Recv(new(int)); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func TestServer_WindowExceeded(t *testing.T) {
+	stream, conn := (&Option{StreamWindow: 1 << 20, ConnWindow: 1 << 20}).windows()
+	assert(stream == maxStreamWindow && conn == maxConnWindow, "expect the windows to be capped, got %d and %d", stream, conn)
+
+	server := NewServer()
+	g := &Gate{entered: make(chan struct{}, 8), open: make(chan struct{})}
+	_ = server.Register(g)
+
+	// a client that sends beyond the stream window has the stream ended
+	client := startTestServer(t, server, &Option{StreamWindow: 4})
+	s, _ := client.NewStream(context.Background(), "Gate.Drain")
+	s.quota.add(1)
+	for i := 0; i < 5; i++ {
+		assert(s.Send(i) == nil, "send %d failed", i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(g.open)
+	err := s.Recv(new(int))
+	assert(CodeOf(err) == ResourceExhausted, "expect the stream to be refused, got %v", err)
+	assert(client.IsAvailable(), "expect the connection to be usable")
+
+	// and beyond the connection window has the connection closed
+	client = startTestServer(t, server, &Option{StreamWindow: 8, ConnWindow: 4})
+	s, _ = client.NewStream(context.Background(), "Gate.Drain")
+	client.quota.add(1)
+	for i := 0; i < 5; i++ {
+		assert(s.Send(i) == nil, "send %d failed", i)
+	}
+	deadline := time.Now().Add(time.Second)
+	for client.IsAvailable() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(!client.IsAvailable(), "expect the server to close the connection")
+}
+
+func TestServer_MaxConcurrentRequests(t *testing.T) {
+	server := NewServer(WithMaxConcurrentRequests(1))
+	_ = server.Register(&Waiter{canceled: make(chan error, 1)})
+	client := startTestServer(t, server)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call(context.Background(), "Waiter.Wait", 200*time.Millisecond, new(int))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	err := client.Call(context.Background(), "Waiter.Wait", time.Millisecond, new(int))
+	assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted over the limit, got %v", err)
+
+	assert(<-done == nil, "expect the admitted call to succeed")
+	err = client.Call(context.Background(), "Waiter.Wait", time.Millisecond, new(int))
+	assert(err == nil, "expect calls to be admitted again, got %v", err)
+}
+
+// Len returns the length of s.
+func (Counter) Len(s string, n *int) error {
+	*n = len(s)
+	return nil
+}
+
+// Repeat returns a string of n x.
+func (Counter) Repeat(n int, s *string) error {
+	*s = strings.Repeat("x", n)
+	return nil
+}
+
+func TestServer_MaxMsgSize(t *testing.T) {
+	server := NewServer(WithMaxRecvMsgSize(1024), WithMaxSendMsgSize(2048))
+	_ = server.Register(Counter{})
+	client := startTestServer(t, server, &Option{MaxRecvMsgSize: 1536, MaxSendMsgSize: 4096})
+	ctx := context.Background()
+
+	var n int
+	err := client.Call(ctx, "Counter.Len", strings.Repeat("x", 2000), &n)
+	assert(CodeOf(err) == ResourceExhausted, "expect the server to refuse large args, got %v", err)
+	err = client.Call(ctx, "Counter.Len", strings.Repeat("x", 5000), &n)
+	assert(CodeOf(err) == ResourceExhausted, "expect the client to refuse to send large args, got %v", err)
+
+	var s string
+	err = client.Call(ctx, "Counter.Repeat", 1800, &s)
+	assert(CodeOf(err) == ResourceExhausted, "expect the client to refuse a large reply, got %v", err)
+	err = client.Call(ctx, "Counter.Repeat", 3000, &s)
+	assert(CodeOf(err) == ResourceExhausted, "expect the server to refuse to send a large reply, got %v", err)
+
+	// none of the above tears the connection down
+	err = client.Call(ctx, "Counter.Len", "hello", &n)
+	assert(err == nil && n == 5, "expect the connection to be usable, got %d: %v", n, err)
+	assert(client.IsAvailable(), "expect the client to be available")
+}
+
+func TestServer_MaxMsgSizeLegacy(t *testing.T) {
+	server := NewServer(WithMaxRecvMsgSize(1024))
+	_ = server.Register(Counter{})
+	for _, typ := range []codec.Type{codec.GobType, codec.JSONType} {
+		client := startTestServer(t, server, &Option{CodecType: typ, JSONHandshake: true, MaxRecvMsgSize: 1536})
+		ctx := context.Background()
+
+		var n int
+		err := client.Call(ctx, "Counter.Len", strings.Repeat("x", 500), &n)
+		assert(err == nil && n == 500, "%s: expect a small message to be read, got %d: %v", typ, n, err)
+		var s string
+		err = client.Call(ctx, "Counter.Repeat", 1800, &s)
+		assert(err != nil, "%s: expect the client to refuse a large reply", typ)
+		assert(!client.IsAvailable(), "%s: expect the client to give up the connection", typ)
+
+		client = startTestServer(t, server, &Option{CodecType: typ, JSONHandshake: true})
+		err = client.Call(ctx, "Counter.Len", strings.Repeat("x", 2000), &n)
+		assert(err != nil, "%s: expect the server to refuse large args", typ)
+		err = client.Call(ctx, "Counter.Len", "hello", &n)
+		assert(err != nil, "%s: expect the server to close the connection", typ)
+	}
+}
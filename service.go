@@ -1,9 +1,12 @@
 package drpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"runtime/debug"
 	"sync/atomic"
 )
 
@@ -11,10 +14,26 @@ import (
 
 // 手动封装的 rpc调用函数类型
 type methodType struct {
-	method   reflect.Method // 方法本身 func Foo(r *xxx.Request, resp *xxx.Response) error {}
+	method   reflect.Method // 方法本身 func Foo([ctx context.Context,] r *xxx.Request, resp *xxx.Response) error {}
 	ArgType  reflect.Type   // 第一个参数 => *xxx.Request
 	RetType  reflect.Type   // 第二个参数 => *xxx.Response
-	NumCalls uint64         // 统计函数调用次数（用于限流）
+	NumCalls uint64         // 统计函数调用次数，限流见 WithRateLimit
+	withCtx  bool           // 方法的第一个参数是否为 context.Context
+	stream   bool           // 第二个参数是否为 ServerStream，即服务端流式方法
+	bidi     bool           // 唯一的参数是 Stream，即客户端流式或双向流式方法
+}
+
+func (m *methodType) streaming() bool {
+	return m.stream || m.bidi
+}
+
+// accepts reports whether argV and retV may be passed to the method,
+// e.g. after an interceptor replaced them.
+func (m *methodType) accepts(argV, retV reflect.Value) bool {
+	if !m.bidi && (!argV.IsValid() || !argV.Type().AssignableTo(m.ArgType)) {
+		return false
+	}
+	return retV.IsValid() && retV.Type().AssignableTo(m.RetType)
 }
 
 func (m *methodType) GetNumCalls() uint64 {
@@ -76,9 +95,19 @@ func newService(rcvr interface{}) *service {
 	return s
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfStream  = reflect.TypeOf((*ServerStream)(nil)).Elem()
+	typeOfBidi    = reflect.TypeOf((*Stream)(nil)).Elem()
+)
+
 // registerMethods 过滤出了符合条件的方法：
 // 两个导出或内置类型的入参（反射时为 3 个，第 0 个是自身，类似于 python 的 self，java 中的 this）
 // 返回值有且只有 1 个，类型为 error
+// 入参之前还可以有一个 context.Context，即 Foo(ctx, *in, *out) error
+// 第二个参数为 ServerStream 时是服务端流式方法，即 Foo(*in, stream ServerStream) error
+// 唯一的参数为 Stream 时是客户端流式或双向流式方法，即 Foo(stream Stream) error
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
@@ -86,22 +115,36 @@ func (s *service) registerMethods() {
 
 		mType := method.Type
 
-		// 只有三个参数，Foo(*self, *in, *out) error
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		numIn := mType.NumIn()
+		if numIn == 2 && mType.In(1) == typeOfBidi {
+			s.method[method.Name] = &methodType{method: method, RetType: typeOfBidi, bidi: true}
+			log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 			continue
 		}
 
-		argType, retType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(retType) {
+		// 三个参数 Foo(*self, *in, *out) error，或者四个参数 Foo(*self, ctx, *in, *out) error
+		if numIn != 3 && numIn != 4 {
+			continue
+		}
+		withCtx := numIn == 4
+		if withCtx && mType.In(1) != typeOfContext {
+			continue
+		}
+
+		argType, retType := mType.In(numIn-2), mType.In(numIn-1)
+		stream := retType == typeOfStream
+		if !isExportedOrBuiltinType(argType) || !(stream || isExportedOrBuiltinType(retType)) {
 			continue
 		}
 		s.method[method.Name] = &methodType{
 			method:  method,
 			ArgType: argType,
 			RetType: retType,
+			withCtx: withCtx,
+			stream:  stream,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
@@ -111,12 +154,37 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(mTyp *methodType, argV, retV reflect.Value) error {
+// panicError 记录服务方法 panic 时的值和调用栈
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// call 反射调用服务方法，方法中的 panic 会被恢复并以 *panicError 返回
+func (s *service) call(ctx context.Context, mTyp *methodType, argV, retV reflect.Value) (err error) {
 	atomic.AddUint64(&mTyp.NumCalls, 1)
 	f := mTyp.method.Func
 
+	defer func() {
+		if r := recover(); r != nil {
+			err = &panicError{value: r, stack: debug.Stack()}
+		}
+	}()
+
+	in := []reflect.Value{s.receiver, argV, retV}
+	switch {
+	case mTyp.bidi:
+		in = []reflect.Value{s.receiver, retV}
+	case mTyp.withCtx:
+		in = []reflect.Value{s.receiver, reflect.ValueOf(ctx), argV, retV}
+	}
+
 	// 反射调用函数
-	returnValues := f.Call([]reflect.Value{s.receiver, argV, retV})
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -1,6 +1,7 @@
 package drpc
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"reflect"
@@ -121,7 +122,7 @@ func TestMethodType_Call(t *testing.T) {
 	retv := mType.newRetv()
 	argv.Set(reflect.ValueOf(Args{1, 3}))
 
-	err := s.call(mType, argv, retv)
+	err := s.call(context.Background(), mType, argv, retv)
 	assert(err == nil && *retv.Interface().(*int) == 4 && mType.NumCalls == 1,
 		"Failed to call Foo.Sum")
 }
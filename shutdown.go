@@ -0,0 +1,179 @@
+package drpc
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/devhg/drpc/codec"
+	"github.com/devhg/drpc/registry"
+)
+
+var errServerShutdown = Errorf(Unavailable, "rpc server: server is shutting down")
+
+// RegisterOnShutdown registers a function to call when Shutdown starts,
+// before the listeners are closed.
+func (server *Server) RegisterOnShutdown(f func()) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.onShutdown = append(server.onShutdown, f)
+}
+
+// Heartbeat registers addr in the registry, see registry.Heartbeat.
+// The server deregisters addr when it shuts down.
+func (server *Server) Heartbeat(registryAddr, addr string, duration time.Duration) {
+	server.HeartbeatWeighted(registryAddr, addr, 0, duration)
+}
+
+// HeartbeatWeighted is Heartbeat for a server with the given weight,
+// see registry.HeartbeatWeighted.
+func (server *Server) HeartbeatWeighted(registryAddr, addr string, weight int, duration time.Duration) {
+	stop := registry.HeartbeatWeighted(registryAddr, addr, weight, duration)
+	server.RegisterOnShutdown(func() {
+		stop()
+		if err := registry.Deregister(registryAddr, addr); err != nil {
+			log.Println("rpc server: deregister error:", err)
+		}
+	})
+}
+
+// Shutdown gracefully shuts down the server:
+// 1) runs the functions registered by RegisterOnShutdown, e.g. deregistration;
+// 2) closes all listeners, so Accept returns;
+// 3) sends GOAWAY on every connection, so clients stop sending new calls;
+// 4) waits for in-flight requests to finish and closes the connections.
+// If ctx expires first, Shutdown closes whatever is left and returns ctx.Err().
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	if server.inShutdown {
+		server.mu.Unlock()
+		return nil
+	}
+	server.inShutdown = true
+	hooks := server.onShutdown
+	server.mu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+	server.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, sc := range server.activeConns() {
+			wg.Add(1)
+			go func(sc *serverConn) {
+				defer wg.Done()
+				sc.goAway()
+				sc.wg.Wait()
+				_ = sc.cc.Close()
+			}(sc)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		_ = server.Close()
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and connections.
+// In-flight requests are abandoned; use Shutdown to wait for them.
+func (server *Server) Close() error {
+	server.mu.Lock()
+	server.inShutdown = true
+	server.mu.Unlock()
+
+	err := server.closeListeners()
+	for _, sc := range server.activeConns() {
+		_ = sc.cc.Close()
+	}
+	return err
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// trackListener adds or removes lis from the listeners closed on shutdown.
+// It refuses to add a listener once the server is shutting down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn is trackListener for connections.
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, sc)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+func (server *Server) closeListeners() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var err error
+	for lis := range server.listeners {
+		if cerr := lis.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(server.listeners, lis)
+	}
+	return err
+}
+
+func (server *Server) activeConns() []*serverConn {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	return conns
+}
+
+// goAway tells the client to stop sending new calls on this connection.
+func (sc *serverConn) goAway() {
+	sc.mu.Lock()
+	sc.goingAway = true
+	sc.mu.Unlock()
+
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	if err := sc.cc.Write(&codec.Header{Kind: codec.KindGoAway}, invalidRequest); err != nil {
+		log.Println("rpc server: write GOAWAY error:", err)
+	}
+}
@@ -0,0 +1,138 @@
+package drpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/devhg/drpc/codec"
+)
+
+// Code is the category of an error returned by a call.
+// The values are the same as gRPC's, so they can be mapped one to one.
+type Code uint32
+
+const (
+	OK                 Code = iota // not an error
+	Canceled                       // the caller canceled the call
+	Unknown                        // an error that carries no code, e.g. a plain error returned by a method
+	InvalidArgument                // the request is malformed
+	DeadlineExceeded               // the call did not finish before its deadline
+	NotFound                       // the service or method does not exist
+	AlreadyExists                  // the entity the call tried to create already exists
+	PermissionDenied               // the caller is not allowed to make the call
+	ResourceExhausted              // a limit was hit, e.g. a rate or size limit
+	FailedPrecondition             // the system is not in a state required for the call
+	Aborted                        // the call was aborted, typically due to a concurrency issue
+	OutOfRange                     // an argument is out of the valid range
+	Unimplemented                  // the call is not supported
+	Internal                       // an invariant of the server is broken, e.g. a panic
+	Unavailable                    // the server cannot take the call right now, retrying may help
+	DataLoss                       // unrecoverable data loss or corruption
+	Unauthenticated                // the caller could not be identified
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// Status is the error returned by calls that failed on the server, or
+// that the client gave up on. Use errors.As to get it from an error.
+type Status struct {
+	Code    Code
+	Message string
+	Details []string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", s.Code, s.Message)
+}
+
+// Errorf returns a *Status error with the given code and formatted message.
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// StatusOf converts err into a *Status. A nil err gives nil.
+// Errors that are not a *Status get code Unknown, except for context
+// errors, ErrShutdown and message size errors, which get their natural code.
+func StatusOf(err error) *Status {
+	if err == nil {
+		return nil
+	}
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+	code := Unknown
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = Canceled
+	case errors.Is(err, ErrShutdown):
+		code = Unavailable
+	case isMsgSizeError(err):
+		code = ResourceExhausted
+	}
+	return &Status{Code: code, Message: err.Error()}
+}
+
+func isMsgSizeError(err error) bool {
+	var e *codec.MsgSizeError
+	return errors.As(err, &e)
+}
+
+// CodeOf returns the Code of err, OK if err is nil.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return StatusOf(err).Code
+}
+
+// setHeaderStatus writes err into the response header h.
+func setHeaderStatus(h *codec.Header, err error) {
+	s := StatusOf(err)
+	h.Code = uint32(s.Code)
+	h.Error = s.Message
+	h.Details = s.Details
+}
+
+// headerStatus reads the error written by setHeaderStatus,
+// nil if the response is not an error.
+func headerStatus(h *codec.Header) error {
+	if h.Code == uint32(OK) && h.Error == "" {
+		return nil
+	}
+	code := Code(h.Code)
+	if code == OK {
+		// 旧版本的服务端只会设置 Error
+		code = Unknown
+	}
+	return &Status{Code: code, Message: h.Error, Details: h.Details}
+}
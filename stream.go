@@ -0,0 +1,470 @@
+package drpc
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/devhg/drpc/codec"
+)
+
+// 流式调用复用同一个 Seq：
+// client -> server: | Header{KindCall, Seq} | args |       打开流，双向流的 args 为空
+// client -> server: | Header{KindStream, Seq} | args1 | Header{KindStream, Seq} | args2 | ...
+// client -> server: | Header{KindStream, Seq, EndStream} | {} |  客户端不再发送
+// server -> client: | Header{KindStream, Seq} | reply1 | Header{KindStream, Seq} | reply2 | ...
+// server -> client: | Header{KindCall, Seq, Error} | {} |  结束流，与普通调用的响应相同
+//
+// 接收方收到流消息时还不知道它的类型，因此先保存未解码的 body，
+// 直到用户调用 Recv 时再解码，这要求 codec 实现 codec.RawReader。
+//
+// 流量控制以消息为单位，分为流和连接两级，窗口大小由客户端在 Option 中给出，两个方向相同。
+// 发送一条流消息同时消耗流和连接的一个额度，任何一个用完时 Send 阻塞。
+// 接收方每取走半个窗口的消息就通过 KindWindowUpdate 把额度还给发送方，Seq 为 0 时归还的是连接的额度。
+// 被丢弃的消息（流已经结束）同样归还连接的额度，避免额度泄漏。
+//
+// 接收方检查发送方是否遵守窗口：超出流窗口的流以 ResourceExhausted 结束，
+// 超出连接窗口的连接被关闭。客户端给出的窗口不能超过 maxStreamWindow 和 maxConnWindow，
+// 更大的值在两端都按上限处理，因此一个连接最多缓存 maxConnWindow 条未被取走的消息，
+// 占用的内存不超过 maxConnWindow 乘以消息大小的上限（见 WithMaxRecvMsgSize）。
+//
+// 窗口只限制消息的数量，不限制字节数，消息也不会被拆分：一条消息总是在持有连接的
+// 发送锁时整个写出。因此一个很大的回复或者流消息仍然会在写出期间阻塞同一连接上的
+// 其他调用，流量控制解决不了大消息造成的队头阻塞。发送的消息默认不超过 4MB，需要时用
+// WithMaxSendMsgSize 和 Option.MaxSendMsgSize 调整，或者把大的结果拆成多条流消息发送。
+
+const (
+	defaultStreamWindow = 64
+	defaultConnWindow   = 16 * defaultStreamWindow
+	maxStreamWindow     = 1 << 10
+	maxConnWindow       = 1 << 12
+)
+
+// recvWindow counts the messages taken by the receiver since the
+// last window update, and tells when the next update is due.
+// It also checks that the sender keeps within the window.
+type recvWindow struct {
+	mu       sync.Mutex
+	size     uint32
+	consumed uint32
+	pending  uint32 // 已收到、额度还没有归还的消息数
+}
+
+func newRecvWindow(size uint32) *recvWindow {
+	return &recvWindow{size: size}
+}
+
+// consume records n taken messages and returns the credit to give back, 0 if none yet.
+func (w *recvWindow) consume(n uint32) uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.consumed += n
+	if w.consumed == 0 || w.consumed < (w.size+1)/2 {
+		return 0
+	}
+	n, w.consumed = w.consumed, 0
+	w.pending -= n
+	return n
+}
+
+// receive records a message arriving within the window. It reports false if
+// the sender has already used up the window, the message is then not recorded.
+func (w *recvWindow) receive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending >= w.size {
+		return false
+	}
+	w.pending++
+	return true
+}
+
+// ServerStream is what a server-streaming method sends its replies with.
+// Such a method has the form
+//
+//	func (t *T) Foo([ctx context.Context,] args *Args, stream drpc.ServerStream) error
+//
+// The stream ends when the method returns; its error is what the client's
+// Recv returns after the last reply.
+type ServerStream interface {
+	// Context returns the context of the call.
+	Context() context.Context
+	// Send sends one reply to the client.
+	Send(reply interface{}) error
+}
+
+// Stream is what client-streaming and bidirectional methods use.
+// Such a method has the form
+//
+//	func (t *T) Foo(stream drpc.Stream) error
+//
+// A client-streaming method receives until io.EOF and sends one reply.
+type Stream interface {
+	ServerStream
+	// Recv receives the next message from the client into args.
+	// It returns io.EOF once the client has called CloseSend.
+	Recv(args interface{}) error
+}
+
+// recvQueue buffers the raw messages of a stream until Recv decodes them.
+type recvQueue struct {
+	win  *recvWindow // 流的窗口
+	conn *recvWindow // 连接的窗口，所有流共享
+
+	mu         sync.Mutex
+	queue      [][]byte      // 已收到但还未被取走的消息
+	uncredited uint32        // queue 中还没有归还连接额度的消息数
+	finished   bool          // 不会再有新消息
+	err        error         // 流结束的原因，nil 表示正常结束
+	notify     chan struct{} // 有新消息时通知
+	done       chan struct{} // finished 时关闭
+}
+
+func newRecvQueue(window uint32, conn *recvWindow) *recvQueue {
+	return &recvQueue{
+		win:    newRecvWindow(window),
+		conn:   conn,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// push queues data unless the stream has already finished, and reports whether it did.
+func (q *recvQueue) push(data []byte) bool {
+	q.mu.Lock()
+	if q.finished {
+		q.mu.Unlock()
+		return false
+	}
+	q.queue = append(q.queue, data)
+	q.uncredited++
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// finish ends the stream with err after the queued messages.
+// Only the first call counts; the error the stream ended with is returned.
+func (q *recvQueue) finish(err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.finished {
+		q.finished, q.err = true, err
+		close(q.done)
+	}
+	return q.err
+}
+
+// release gives back the connection credit of the queued messages, once the
+// stream is over and they no longer need to be accounted for. It returns the
+// connection window update that is due, 0 if none.
+func (q *recvQueue) release() uint32 {
+	q.mu.Lock()
+	n := q.uncredited
+	q.uncredited = 0
+	q.mu.Unlock()
+	return q.conn.consume(n)
+}
+
+// windowUpdate is the credit a receiver gives back for one stream.
+type windowUpdate struct {
+	stream uint32 // 流的额度
+	conn   uint32 // 连接的额度
+}
+
+// next blocks until a message arrives and returns it together with the credit
+// that is due to the sender. At the end of the stream it returns io.EOF or
+// the error passed to finish, and ctx.Err() if ctx is done first.
+func (q *recvQueue) next(ctx context.Context) (data []byte, update windowUpdate, err error) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			data = q.queue[0]
+			q.queue = q.queue[1:]
+			update.stream = q.win.consume(1)
+			if q.uncredited > 0 {
+				q.uncredited--
+				update.conn = q.conn.consume(1)
+			}
+			q.mu.Unlock()
+			return data, update, nil
+		}
+		finished, err := q.finished, q.err
+		q.mu.Unlock()
+
+		if finished {
+			if err != nil {
+				return nil, update, err
+			}
+			return nil, update, io.EOF
+		}
+
+		select {
+		case <-q.notify:
+		case <-q.done:
+		case <-ctx.Done():
+			return nil, update, ctx.Err()
+		}
+	}
+}
+
+// sendQuota counts how many more messages the peer is willing to buffer.
+type sendQuota struct {
+	mu     sync.Mutex
+	credit uint32
+	notify chan struct{}
+}
+
+func newSendQuota(credit uint32) *sendQuota {
+	return &sendQuota{credit: credit, notify: make(chan struct{}, 1)}
+}
+
+func (q *sendQuota) add(n uint32) {
+	q.mu.Lock()
+	q.credit += n
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// acquire takes one credit, blocking until there is one. It returns ctx.Err()
+// if ctx is done first, and io.EOF if done is closed first.
+func (q *sendQuota) acquire(ctx context.Context, done <-chan struct{}) error {
+	for {
+		q.mu.Lock()
+		if q.credit > 0 {
+			q.credit--
+			q.mu.Unlock()
+			return nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-done:
+			return io.EOF
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serverStream is created by ServeCodec when a streaming call arrives,
+// so that the messages following the call can be routed to it right away.
+type serverStream struct {
+	ctx   context.Context // set by handleRequest before the method is called
+	sc    *serverConn
+	seq   uint64
+	raw   codec.RawReader // nil if the codec cannot hold messages, Recv is then unsupported
+	recv  *recvQueue
+	quota *sendQuota
+}
+
+var _ Stream = (*serverStream)(nil)
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) Send(reply interface{}) error {
+	if err := s.quota.acquire(s.ctx, nil); err != nil {
+		return StatusOf(err)
+	}
+	if err := s.sc.quota.acquire(s.ctx, nil); err != nil {
+		return StatusOf(err)
+	}
+	s.sc.sending.Lock()
+	defer s.sc.sending.Unlock()
+	// 方法返回、超时或者客户端取消之后都不能再发送，
+	// 在锁内检查，保证不会跟在结束流的响应之后
+	if err := s.ctx.Err(); err != nil {
+		return StatusOf(err)
+	}
+	return s.sc.cc.Write(&codec.Header{Seq: s.seq, Kind: codec.KindStream}, reply)
+}
+
+func (s *serverStream) Recv(args interface{}) error {
+	data, update, err := s.recv.next(s.ctx)
+	if err == io.EOF {
+		return err
+	}
+	if err != nil {
+		return StatusOf(err)
+	}
+	s.sc.sendWindowUpdate(s.seq, update)
+	return s.raw.Unmarshal(data, args)
+}
+
+// ClientStream is the client side of a streaming call.
+// Send and Recv may be called from two different goroutines,
+// but neither of them from several goroutines at once.
+type ClientStream struct {
+	c     *Client
+	call  *Call
+	ctx   context.Context
+	raw   codec.RawReader
+	recv  *recvQueue
+	quota *sendQuota
+
+	mu         sync.Mutex
+	sendClosed bool
+}
+
+// Stream calls a server-streaming method and returns the stream its replies
+// arrive on. Cancelling ctx cancels the call. Client interceptors are not
+// applied to streams.
+func (c *Client) Stream(ctx context.Context, serviceMethod string, args interface{}) (*ClientStream, error) {
+	return c.newStream(ctx, serviceMethod, args, true)
+}
+
+// NewStream opens a stream to a client-streaming or bidirectional method.
+// Messages are sent with Send and replies arrive on Recv.
+// Cancelling ctx cancels the call.
+func (c *Client) NewStream(ctx context.Context, serviceMethod string) (*ClientStream, error) {
+	return c.newStream(ctx, serviceMethod, invalidRequest, false)
+}
+
+func (c *Client) newStream(ctx context.Context, serviceMethod string, args interface{}, sendClosed bool) (*ClientStream, error) {
+	raw, ok := c.cc.(codec.RawReader)
+	if !ok {
+		return nil, Errorf(Unimplemented, "rpc client: codec %s does not support streaming", c.opt.CodecType)
+	}
+
+	call := c.newCall(serviceMethod, args, nil, make(chan *Call, 1))
+	call.ctx = ctx
+	stream := &ClientStream{
+		c:          c,
+		call:       call,
+		ctx:        ctx,
+		raw:        raw,
+		recv:       newRecvQueue(c.streamWindow, c.recvWindow),
+		quota:      newSendQuota(c.streamWindow),
+		sendClosed: sendClosed,
+	}
+	call.stream = stream
+	c.send(call)
+	// 与 invoke 一样，ctx 结束时取消流，即使此时没有在 Send 或 Recv 中等待
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = stream.cancel(ctx.Err())
+		case <-stream.recv.done:
+		}
+	}()
+	return stream, nil
+}
+
+// Send sends one message to the server. It returns io.EOF if the server
+// has already ended the stream; Recv then returns the reason.
+func (s *ClientStream) Send(args interface{}) error {
+	s.mu.Lock()
+	closed := s.sendClosed
+	s.mu.Unlock()
+	if closed {
+		return Errorf(FailedPrecondition, "rpc client: send on closed stream")
+	}
+
+	for _, q := range []*sendQuota{s.quota, s.c.quota} {
+		if err := q.acquire(s.ctx, s.recv.done); err != nil {
+			if err == io.EOF {
+				return err
+			}
+			return s.cancel(err)
+		}
+	}
+	return s.c.sendStream(&codec.Header{Seq: s.call.Seq, Kind: codec.KindStream}, args)
+}
+
+// CloseSend tells the server that no more messages will be sent.
+func (s *ClientStream) CloseSend() error {
+	s.mu.Lock()
+	if s.sendClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	s.mu.Unlock()
+
+	h := &codec.Header{Seq: s.call.Seq, Kind: codec.KindStream, EndStream: true}
+	if err := s.c.sendStream(h, invalidRequest); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Recv decodes the next reply into reply. After the last reply it returns
+// io.EOF if the method succeeded, or the error the method returned.
+func (s *ClientStream) Recv(reply interface{}) error {
+	data, update, err := s.recv.next(s.ctx)
+	if err != nil {
+		if err == s.ctx.Err() {
+			return s.cancel(err)
+		}
+		return err
+	}
+	s.c.sendWindowUpdate(s.call.Seq, update)
+	return s.raw.Unmarshal(data, reply)
+}
+
+// CloseAndRecv closes the sending side, then waits for the single reply
+// of a client-streaming method and for the method to return.
+func (s *ClientStream) CloseAndRecv(reply interface{}) error {
+	if err := s.CloseSend(); err != nil {
+		return err
+	}
+	if err := s.Recv(reply); err != nil {
+		if err == io.EOF {
+			return Errorf(Internal, "rpc client: stream ended without a reply")
+		}
+		return err
+	}
+	_, update, err := s.recv.next(s.ctx)
+	s.c.sendWindowUpdate(s.call.Seq, update)
+	switch {
+	case err == io.EOF:
+		return nil
+	case err == nil:
+		return Errorf(Internal, "rpc client: client-streaming method sent more than one reply")
+	case err == s.ctx.Err():
+		return s.cancel(err)
+	default:
+		return err
+	}
+}
+
+// Trailer returns the trailer set by the method. It is only valid
+// after Recv has returned a non-nil error.
+func (s *ClientStream) Trailer() Metadata {
+	return s.call.Trailer
+}
+
+// Close stops receiving and tells the server to cancel the call
+// if it has not finished yet.
+func (s *ClientStream) Close() error {
+	_ = s.cancel(context.Canceled)
+	return nil
+}
+
+// cancel ends the stream because of the context error err.
+func (s *ClientStream) cancel(err error) error {
+	return s.fail(&Status{Code: StatusOf(err).Code, Message: "rpc client: stream failed: " + err.Error()})
+}
+
+// fail ends the stream locally with err, cancels it on the server,
+// and returns the error the stream ended with.
+func (s *ClientStream) fail(err error) error {
+	if s.c.removeCall(s.call.Seq) != nil {
+		go func() {
+			s.c.sendCancel(s.call.Seq)
+			s.c.sendWindowUpdate(0, windowUpdate{conn: s.recv.release()})
+		}()
+	}
+	return s.recv.finish(err)
+}
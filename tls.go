@@ -0,0 +1,104 @@
+package drpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the server side TLS handshake of a new connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// DialTLS connects to an RPC server at the specified network address over TLS.
+// If config has no ServerName, the host part of addr is used.
+// The TLS handshake counts towards Option.ConnectTimeout.
+func DialTLS(network, addr string, config *tls.Config, opts ...*Option) (*Client, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+
+	return dialTimeout(func(conn net.Conn, opt *Option) (*Client, error) {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return NewClient(tlsConn, opt)
+	}, network, addr, opts...)
+}
+
+// ListenTLS returns a listener whose connections are TLS, to be passed
+// to Server.Accept. Set config.ClientAuth to tls.RequireAndVerifyClientCert
+// and config.ClientCAs for mutual TLS; the client certificate is then
+// available to handlers through PeerFromContext.
+func ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return nil, errors.New("rpc server: ListenTLS needs a certificate in config")
+	}
+	return tls.Listen(network, addr, config)
+}
+
+// Peer describes the client of the request being handled.
+type Peer struct {
+	Addr net.Addr             // nil if the connection is not a net.Conn
+	TLS  *tls.ConnectionState // nil if the connection is not TLS
+}
+
+// Certificate returns the certificate the client presented with mutual TLS,
+// nil if there is none. If the server verified it, it is the leaf of the
+// verified chain.
+func (p *Peer) Certificate() *x509.Certificate {
+	if p.TLS == nil {
+		return nil
+	}
+	if len(p.TLS.VerifiedChains) > 0 && len(p.TLS.VerifiedChains[0]) > 0 {
+		return p.TLS.VerifiedChains[0][0]
+	}
+	if len(p.TLS.PeerCertificates) > 0 {
+		return p.TLS.PeerCertificates[0]
+	}
+	return nil
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the client of the request handled with ctx.
+// It is meant for service methods and ServerInterceptors.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// newPeer completes the TLS handshake of conn, if it is a TLS connection,
+// and describes its client.
+func newPeer(conn io.ReadWriteCloser) (*Peer, error) {
+	p := new(Peer)
+	if c, ok := conn.(net.Conn); ok {
+		p.Addr = c.RemoteAddr()
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return p, nil
+	}
+
+	// 握手通常在第一次读写时才发生，这里提前完成，以便在处理请求之前拿到客户端证书
+	_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	state := tlsConn.ConnectionState()
+	p.TLS = &state
+	return p, nil
+}
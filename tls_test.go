@@ -0,0 +1,93 @@
+package drpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate for name signed by parent, self-signed if parent is nil.
+func issue(t *testing.T, name string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type Identity struct{}
+
+func (Identity) Whoami(ctx context.Context, _ int, reply *string) error {
+	p, ok := PeerFromContext(ctx)
+	if !ok || p.Certificate() == nil {
+		return Errorf(Unauthenticated, "no client certificate")
+	}
+	*reply = p.Certificate().Subject.CommonName
+	return nil
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	ca := issue(t, "test ca", nil, true)
+	serverCert := issue(t, "server", &ca, false)
+	clientCert := issue(t, "alice", &ca, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	l, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	assert(err == nil, "listen error: %v", err)
+	server := NewServer()
+	_ = server.Register(Identity{})
+	go server.Accept(l)
+	defer func() { _ = server.Close() }()
+
+	client, err := XDial("tls@"+l.Addr().String(), &Option{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+	}})
+	assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var name string
+	err = client.Call(context.Background(), "Identity.Whoami", 0, &name)
+	assert(err == nil && name == "alice", "expect the client certificate identity, got %q: %v", name, err)
+
+	// a client without a certificate is refused
+	_, err = DialTLS("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	assert(err != nil, "expect a client without certificate to be rejected")
+
+	// a client that does not trust the server certificate is refused
+	_, err = DialTLS("tcp", l.Addr().String(), &tls.Config{Certificates: []tls.Certificate{clientCert}})
+	assert(err != nil, "expect an untrusted server certificate to be rejected")
+}
@@ -0,0 +1,199 @@
+package xclient
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 负载均衡：Discovery.Get 把服务列表交给 SelectMode 对应的 Balancer 选择。
+// 每个 Discovery 拥有自己的 Balancer 实例，因为轮询之类的算法需要保存状态。
+// 加权轮询使用平滑加权轮询（与 nginx 相同），避免权重大的服务连续被选中。
+
+// Candidate is a server a Balancer may choose.
+type Candidate struct {
+	Addr   string
+	Weight int // from the registry or SetWeights, 1 if unknown
+	Active int // calls in flight to the server, see LoadReporter and LoadAwareBalancer
+}
+
+// Balancer chooses a server among candidates, which is never empty.
+// Pick is called concurrently.
+type Balancer interface {
+	Pick(candidates []Candidate) string
+}
+
+// LoadAwareBalancer is a Balancer that chooses by Candidate.Active.
+// Finding out the load costs a lookup per server on every pick, so
+// MultiServerDiscovery only fills Active in for such Balancers.
+type LoadAwareBalancer interface {
+	Balancer
+	UsesLoad() bool
+}
+
+// LoadReporter tells balancers how many calls are in flight to a server.
+// NewXClient gives itself to its Discovery if the Discovery has a
+// SetLoadReporter method, as MultiServerDiscovery does.
+type LoadReporter interface {
+	ActiveRequests(rpcAddr string) int
+}
+
+var errNoServers = errors.New("rpc discovery: no available servers")
+
+// lockedRand is a rand.Rand safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Intn(n)
+}
+
+// RandomBalancer chooses a server at random.
+type RandomBalancer struct {
+	r *lockedRand
+}
+
+func NewRandomBalancer() *RandomBalancer {
+	return &RandomBalancer{r: newLockedRand()}
+}
+
+func (b *RandomBalancer) Pick(candidates []Candidate) string {
+	return candidates[b.r.Intn(len(candidates))].Addr
+}
+
+// RoundRobinBalancer chooses the servers in turn.
+type RoundRobinBalancer struct {
+	mu    sync.Mutex
+	index int
+}
+
+// NewRoundRobinBalancer returns a RoundRobinBalancer starting at a random server,
+// so that clients started together do not all begin with the same one.
+func NewRoundRobinBalancer() *RoundRobinBalancer {
+	return &RoundRobinBalancer{index: newLockedRand().Intn(1 << 30)}
+}
+
+func (b *RoundRobinBalancer) Pick(candidates []Candidate) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addr := candidates[b.index%len(candidates)].Addr
+	b.index = (b.index + 1) % len(candidates)
+	return addr
+}
+
+// WeightedRoundRobinBalancer chooses the servers in turn, each in
+// proportion to its weight.
+type WeightedRoundRobinBalancer struct {
+	mu      sync.Mutex
+	current map[string]int // addr -> current weight of smooth weighted round robin
+}
+
+func NewWeightedRoundRobinBalancer() *WeightedRoundRobinBalancer {
+	return &WeightedRoundRobinBalancer{current: make(map[string]int)}
+}
+
+func (b *WeightedRoundRobinBalancer) Pick(candidates []Candidate) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 每次选择时所有服务的当前权重加上各自的权重，选中当前权重最大的服务，再减去总权重
+	total, best := 0, -1
+	for i, c := range candidates {
+		w := c.Weight
+		if w <= 0 {
+			w = 1
+		}
+		total += w
+		b.current[c.Addr] += w
+		if best < 0 || b.current[c.Addr] > b.current[candidates[best].Addr] {
+			best = i
+		}
+	}
+	addr := candidates[best].Addr
+	b.current[addr] -= total
+
+	if len(b.current) > len(candidates) {
+		// 服务列表变化后，清理已经下线的服务
+		alive := make(map[string]bool, len(candidates))
+		for _, c := range candidates {
+			alive[c.Addr] = true
+		}
+		for a := range b.current {
+			if !alive[a] {
+				delete(b.current, a)
+			}
+		}
+	}
+	return addr
+}
+
+// LeastActiveBalancer chooses the server with the fewest calls in flight,
+// at random among equals.
+type LeastActiveBalancer struct {
+	r *lockedRand
+}
+
+func NewLeastActiveBalancer() *LeastActiveBalancer {
+	return &LeastActiveBalancer{r: newLockedRand()}
+}
+
+func (b *LeastActiveBalancer) UsesLoad() bool { return true }
+
+func (b *LeastActiveBalancer) Pick(candidates []Candidate) string {
+	start := b.r.Intn(len(candidates))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		if c := candidates[(start+i)%len(candidates)]; c.Active < best.Active {
+			best = c
+		}
+	}
+	return best.Addr
+}
+
+// PowerOfTwoBalancer chooses two servers at random and takes the one with
+// fewer calls in flight. It avoids the herding of LeastActiveBalancer when
+// many clients see the same loads.
+type PowerOfTwoBalancer struct {
+	r *lockedRand
+}
+
+func NewPowerOfTwoBalancer() *PowerOfTwoBalancer {
+	return &PowerOfTwoBalancer{r: newLockedRand()}
+}
+
+func (b *PowerOfTwoBalancer) UsesLoad() bool { return true }
+
+func (b *PowerOfTwoBalancer) Pick(candidates []Candidate) string {
+	n := len(candidates)
+	if n == 1 {
+		return candidates[0].Addr
+	}
+	i := b.r.Intn(n)
+	j := b.r.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	if candidates[j].Active < candidates[i].Active {
+		i = j
+	}
+	return candidates[i].Addr
+}
+
+// newBalancers returns the Balancers of the built-in SelectModes.
+func newBalancers() map[SelectMode]Balancer {
+	return map[SelectMode]Balancer{
+		RandomSelect:             NewRandomBalancer(),
+		RoundRobinSelect:         NewRoundRobinBalancer(),
+		WeightedRoundRobinSelect: NewWeightedRoundRobinBalancer(),
+		LeastActiveSelect:        NewLeastActiveBalancer(),
+		PowerOfTwoSelect:         NewPowerOfTwoBalancer(),
+	}
+}
@@ -0,0 +1,271 @@
+package xclient
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/devhg/drpc"
+)
+
+// 熔断器按服务地址维护，有三种状态：
+// closed：正常放行，连续失败次数或者窗口内的错误率超过阈值时进入 open。
+// open：拒绝所有请求，选择服务时跳过该地址，OpenTimeout 之后进入 half-open。
+// half-open：放行 HalfOpenRequests 个试探请求，全部成功则回到 closed，任何一个失败则回到 open。
+// 只有表明服务端不健康的错误才算失败，参数错误之类的业务错误不算。
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultErrorRate           = 0.5
+	defaultMinRequests         = 20
+	defaultBreakerWindow       = 10 * time.Second
+	defaultOpenTimeout         = 5 * time.Second
+)
+
+// BreakerState is the state of the circuit breaker of a server.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go through
+	BreakerOpen                         // calls fail right away
+	BreakerHalfOpen                     // a few trial calls go through
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerPolicy tells when the circuit of a server opens and closes again,
+// see WithCircuitBreaker.
+type BreakerPolicy struct {
+	// ConsecutiveFailures opens the circuit after as many failures in a row, 5 if 0.
+	ConsecutiveFailures int
+	// ErrorRate opens the circuit when that part of the calls of the current
+	// Window (10s if 0) failed, 0.5 if 0. It needs MinRequests (20 if 0) calls
+	// in the window.
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout is how long the circuit stays open before trial calls, 5s if 0.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is how many trial calls must succeed to close the circuit, 1 if 0.
+	HalfOpenRequests int
+	// OnStateChange, if set, is called when the circuit of rpcAddr changes state,
+	// e.g. to update metrics. It must not block.
+	OnStateChange func(rpcAddr string, from, to BreakerState)
+}
+
+// BreakerStats describes the circuit breaker of a server, see XClient.Breakers.
+type BreakerStats struct {
+	State               BreakerState
+	ConsecutiveFailures int
+	Requests            int // calls in the current window
+	Failures            int // failed calls in the current window
+}
+
+// WithCircuitBreaker gives every server a circuit breaker. Servers whose circuit
+// is open are not chosen, and calls to them fail with Unavailable.
+// BroadCast bypasses the breakers.
+func WithCircuitBreaker(p BreakerPolicy) XClientOption {
+	return func(xc *XClient) {
+		if p.ConsecutiveFailures <= 0 {
+			p.ConsecutiveFailures = defaultConsecutiveFailures
+		}
+		if p.ErrorRate <= 0 {
+			p.ErrorRate = defaultErrorRate
+		}
+		if p.MinRequests <= 0 {
+			p.MinRequests = defaultMinRequests
+		}
+		if p.Window <= 0 {
+			p.Window = defaultBreakerWindow
+		}
+		if p.OpenTimeout <= 0 {
+			p.OpenTimeout = defaultOpenTimeout
+		}
+		if p.HalfOpenRequests <= 0 {
+			p.HalfOpenRequests = 1
+		}
+		xc.breakers = &breakerSet{policy: p, m: make(map[string]*breaker)}
+	}
+}
+
+// Breakers returns the circuit breakers of the servers called so far,
+// nil without WithCircuitBreaker.
+func (xc *XClient) Breakers() map[string]BreakerStats {
+	if xc.breakers == nil {
+		return nil
+	}
+	xc.breakers.mu.Lock()
+	defer xc.breakers.mu.Unlock()
+	stats := make(map[string]BreakerStats, len(xc.breakers.m))
+	for rpcAddr, b := range xc.breakers.m {
+		stats[rpcAddr] = b.stats()
+	}
+	return stats
+}
+
+// isFailure reports whether err says that the server is unhealthy.
+func isFailure(err error) bool {
+	switch CodeOf(err) {
+	case Unknown, DeadlineExceeded, ResourceExhausted, Internal, Unavailable, DataLoss:
+		return true
+	}
+	return false
+}
+
+type breakerSet struct {
+	policy BreakerPolicy
+	mu     sync.Mutex
+	m      map[string]*breaker
+}
+
+// get returns the breaker of rpcAddr. A nil set has nil breakers,
+// which let everything through.
+func (s *breakerSet) get(rpcAddr string) *breaker {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.m[rpcAddr]
+	if b == nil {
+		b = &breaker{addr: rpcAddr, policy: &s.policy}
+		s.m[rpcAddr] = b
+	}
+	return b
+}
+
+type breaker struct {
+	addr   string
+	policy *BreakerPolicy
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	trials      int // trial calls in flight or done, in half-open
+	successes   int // successful trial calls
+}
+
+// selectable reports whether the server may be chosen: its circuit is closed,
+// or half-open with room for another trial call, or has been open long enough
+// for a trial call.
+func (b *breaker) selectable() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.policy.OpenTimeout
+	case BreakerHalfOpen:
+		return b.trials < b.policy.HalfOpenRequests
+	}
+	return true
+}
+
+// allow reports whether a call may go to the server. Allowed calls must be
+// followed by done.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.policy.OpenTimeout {
+		b.setState(BreakerHalfOpen)
+	}
+	switch b.state {
+	case BreakerOpen:
+		return Errorf(Unavailable, "rpc xclient: circuit of %s is open", b.addr)
+	case BreakerHalfOpen:
+		if b.trials >= b.policy.HalfOpenRequests {
+			return Errorf(Unavailable, "rpc xclient: circuit of %s is half-open", b.addr)
+		}
+		b.trials++
+	}
+	return nil
+}
+
+// done records the result of an allowed call. Calls canceled by the caller
+// do not say anything about the server and are not counted.
+func (b *breaker) done(err error, canceled bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failed := err != nil && isFailure(err)
+
+	if b.state == BreakerHalfOpen {
+		switch {
+		case canceled:
+			b.trials--
+		case failed:
+			b.setState(BreakerOpen)
+		default:
+			if b.successes++; b.successes >= b.policy.HalfOpenRequests {
+				b.setState(BreakerClosed)
+			}
+		}
+		return
+	}
+	if b.state != BreakerClosed || canceled {
+		return
+	}
+
+	if now := time.Now(); now.Sub(b.windowStart) >= b.policy.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.consecutive >= b.policy.ConsecutiveFailures ||
+		(b.requests >= b.policy.MinRequests && float64(b.failures) >= b.policy.ErrorRate*float64(b.requests)) {
+		b.setState(BreakerOpen)
+	}
+}
+
+// setState moves the breaker to state and resets the counters of the new state.
+func (b *breaker) setState(state BreakerState) {
+	from := b.state
+	b.state = state
+	b.trials, b.successes = 0, 0
+	switch state {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+	case BreakerClosed:
+		b.consecutive, b.requests, b.failures = 0, 0, 0
+		b.windowStart = time.Now()
+	}
+	if b.policy.OnStateChange != nil && from != state {
+		b.policy.OnStateChange(b.addr, from, state)
+	}
+}
+
+func (b *breaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutive,
+		Requests:            b.requests,
+		Failures:            b.failures,
+	}
+}
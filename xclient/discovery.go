@@ -2,10 +2,7 @@ package xclient
 
 import (
 	"errors"
-	"math"
-	"math/rand"
 	"sync"
-	"time"
 )
 
 // 服务发现接口
@@ -13,8 +10,11 @@ import (
 type SelectMode int
 
 const (
-	RandomSelect     SelectMode = iota // select randomly
-	RoundRobinSelect                   // select using Robbin algorithm
+	RandomSelect             SelectMode = iota // select randomly
+	RoundRobinSelect                           // select using Robbin algorithm
+	WeightedRoundRobinSelect                   // select in turn in proportion to the weights
+	LeastActiveSelect                          // select the server with the fewest calls in flight
+	PowerOfTwoSelect                           // select the less busy of two random servers
 )
 
 type Discovery interface {
@@ -26,19 +26,19 @@ type Discovery interface {
 }
 
 type MultiServerDiscovery struct {
-	r       *rand.Rand
-	mu      sync.RWMutex
-	servers []string
-	index   int
+	mu        sync.RWMutex
+	servers   []string
+	weights   map[string]int // see SetWeights
+	balancers map[SelectMode]Balancer
+	load      LoadReporter
 }
 
 func NewMultiServerDiscovery(servers []string) *MultiServerDiscovery {
-	d := &MultiServerDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	return &MultiServerDiscovery{
+		servers:   servers,
+		weights:   make(map[string]int),
+		balancers: newBalancers(),
 	}
-	d.index = d.r.Intn(math.MaxInt32 - 1)
-	return d
 }
 
 var _ Discovery = (*MultiServerDiscovery)(nil)
@@ -56,24 +56,61 @@ func (d *MultiServerDiscovery) Update(servers []string) error {
 	return nil
 }
 
+// SetWeights sets the weights used by WeightedRoundRobinSelect, by address.
+// Servers without a weight weigh 1.
+func (d *MultiServerDiscovery) SetWeights(weights map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = make(map[string]int, len(weights))
+	for addr, w := range weights {
+		d.weights[addr] = w
+	}
+}
+
+// SetBalancer makes mode select servers with b. It replaces the Balancer
+// of a built-in mode, or adds a new mode.
+func (d *MultiServerDiscovery) SetBalancer(mode SelectMode, b Balancer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.balancers[mode] = b
+}
+
+// SetLoadReporter sets where LeastActiveSelect and PowerOfTwoSelect learn
+// the calls in flight to each server. NewXClient calls it with the XClient.
+func (d *MultiServerDiscovery) SetLoadReporter(r LoadReporter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.load = r
+}
+
 // Get gets a server by mode
 func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.RLock()
-	defer d.mu.RUnlock()
 	n := len(d.servers)
-	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
-	}
-	switch mode {
-	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		server := d.servers[d.index%n]
-		d.index = (d.index + 1) % n
-		return server, nil
-	default:
+	b := d.balancers[mode]
+	if n == 0 || b == nil {
+		d.mu.RUnlock()
+		if n == 0 {
+			return "", errNoServers
+		}
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
+	candidates := make([]Candidate, n)
+	for i, addr := range d.servers {
+		candidates[i] = Candidate{Addr: addr, Weight: 1}
+		if w, ok := d.weights[addr]; ok {
+			candidates[i].Weight = w
+		}
+	}
+	load := d.load
+	d.mu.RUnlock()
+
+	if lb, ok := b.(LoadAwareBalancer); ok && lb.UsesLoad() && load != nil {
+		for i := range candidates {
+			candidates[i].Active = load.ActiveRequests(candidates[i].Addr)
+		}
+	}
+	return b.Pick(candidates), nil
 }
 
 // GetAll return all the servers in discovery
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/devhg/drpc/registry"
 )
 
 type DrpcRegistryDiscovery struct {
@@ -63,6 +65,7 @@ func (dr *DrpcRegistryDiscovery) Refresh() error {
 			dr.servers = append(dr.servers, server)
 		}
 	}
+	dr.weights = registry.ParseWeights(resp.Header.Get("X-Drpc-Weights"))
 
 	dr.lastUpdate = time.Now()
 	return nil
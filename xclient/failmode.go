@@ -0,0 +1,160 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// FailMode decides what Call does when an attempt fails, see WithFailMode.
+type FailMode int
+
+// 零值不是 Failover，而是单独的默认模式：没有 RetryPolicy 时只尝试一次，与以前相同，
+// 有 RetryPolicy 时像 Failover 一样换一个服务重试。
+
+const (
+	failDefault FailMode = iota
+	// Failover retries on another server. Calls that never left the client,
+	// e.g. because the connection failed, are retried even without a
+	// RetryPolicy, up to 3 attempts; WithRetryPolicy also retries the others.
+	Failover
+	// Failfast returns the error of the first attempt.
+	Failfast
+	// Failtry is Failover on the server of the first attempt.
+	Failtry
+	// Failbackup sends the call to a second server if the first one has not
+	// replied within the backup latency, see WithBackupLatency, and returns the
+	// first successful reply. RetryPolicy does not apply.
+	Failbackup
+)
+
+const defaultBackupLatency = 10 * time.Millisecond
+
+// defaultFailAttempts bounds the attempts of Failover and Failtry without a RetryPolicy.
+const defaultFailAttempts = 3
+
+// WithFailMode sets the FailMode of Call. By default Call makes a single
+// attempt, or retries on another server as told by WithRetryPolicy.
+func WithFailMode(mode FailMode) XClientOption {
+	return func(xc *XClient) {
+		xc.failMode = mode
+	}
+}
+
+// WithBackupLatency sets how long Failbackup waits for a reply before sending
+// the call to another server, 10ms by default.
+func WithBackupLatency(d time.Duration) XClientOption {
+	return func(xc *XClient) {
+		xc.backupLatency = d
+	}
+}
+
+// backupCall serves Failbackup.
+func (xc *XClient) backupCall(ctx context.Context, serviceMethod string, args, ret interface{}) error {
+	delay := xc.backupLatency
+	if delay <= 0 {
+		delay = defaultBackupLatency
+	}
+	return xc.race(ctx, serviceMethod, args, ret, delay, 2, nil)
+}
+
+var errHedgeCapped = errors.New("rpc xclient: too many outstanding hedges")
+
+// race sends the call to a server, then to another one every delay until a
+// reply arrives or copies servers have it. The first successful reply is
+// stored in ret and the other copies are canceled. A copy that fails makes
+// room for the next one right away. Copies past the first one are hedges,
+// see HedgePolicy.MaxOutstanding.
+// observe, if not nil, gets the latency of the first copy when the race is
+// won: its own if it won, or a lower bound of it if a hedge won while it was
+// still running.
+func (xc *XClient) race(ctx context.Context, serviceMethod string,
+	args, ret interface{}, delay time.Duration, copies int, observe func(time.Duration)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		reply interface{}
+		err   error
+		hedge bool
+	}
+	results := make(chan result, copies)
+	tried := make(map[string]bool)
+	launch := func(hedge bool) error {
+		if hedge && !xc.acquireHedge() {
+			return errHedgeCapped
+		}
+		rpcAddr, err := xc.pick(tried)
+		if err != nil {
+			if hedge {
+				xc.releaseHedge()
+			}
+			return err
+		}
+		tried[rpcAddr] = true
+		// 每份请求使用自己的 reply，避免并发写入 ret
+		var reply interface{}
+		if ret != nil {
+			reply = reflect.New(reflect.ValueOf(ret).Elem().Type()).Interface()
+		}
+		go func() {
+			err := xc.call(ctx, rpcAddr, serviceMethod, args, reply)
+			if hedge {
+				xc.releaseHedge()
+			}
+			results <- result{reply, err, hedge}
+		}()
+		return nil
+	}
+
+	start := time.Now()
+	if err := launch(false); err != nil {
+		return err
+	}
+	launched, running := 1, 1
+	firstRunning := true
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for running > 0 {
+		next := false
+		select {
+		case <-timer.C:
+			next = true
+		case r := <-results:
+			running--
+			if r.err == nil {
+				if observe != nil && (firstRunning || !r.hedge) {
+					observe(time.Since(start))
+				}
+				if ret != nil {
+					reflect.ValueOf(ret).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return nil
+			}
+			if !r.hedge {
+				firstRunning = false
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			next = ctx.Err() == nil
+		}
+		if next && launched < copies {
+			if err := launch(true); err == nil {
+				launched++
+				running++
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(delay)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,150 @@
+package xclient
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 对冲请求：在一段时间内没有收到回复时，把同一个请求发给另一个服务，使用最先成功的回复，
+// 并取消其余的请求。对冲会让服务端重复执行请求，因此只用于通过 WithHedging 显式开启的方法。
+// 等待的时间可以是固定的，也可以是该方法最近延迟的某个分位数。
+
+const (
+	latencySamples    = 128 // 每个方法保留的最近延迟样本数
+	minLatencySamples = 20  // 样本数少于这个值时使用 HedgePolicy.Delay
+)
+
+// HedgePolicy tells Call when to hedge the methods of WithHedging.
+type HedgePolicy struct {
+	// Delay is how long to wait for a reply before each hedge, 10ms if 0.
+	Delay time.Duration
+	// Percentile, e.g. 0.95, waits for that percentile of the latencies of the
+	// recent calls of the method instead, once there are enough of them.
+	// It is within (0, 1]; 0 or less uses Delay only, more than 1 means 1.
+	// The latencies are those of the first server each call is sent to, so
+	// that hedges winning the race do not lower the delay.
+	Percentile float64
+	// MaxHedges is how many more servers a call may be sent to, 1 if 0.
+	MaxHedges int
+	// MaxOutstanding caps the hedges in flight over the whole XClient, the
+	// backups of Failbackup included. Calls past it wait for their first
+	// server only. 0 means no cap.
+	MaxOutstanding int
+}
+
+// WithHedging hedges the methods matched by the patterns as told by p.
+// A pattern is "Service.Method" or "Service.*". Hedged methods are not
+// retried, see FailMode.
+func WithHedging(p HedgePolicy, patterns ...string) XClientOption {
+	return func(xc *XClient) {
+		if !(p.Percentile > 0) {
+			p.Percentile = 0
+		} else if p.Percentile > 1 {
+			p.Percentile = 1
+		}
+		xc.hedge = p
+		for _, pattern := range patterns {
+			xc.hedged[pattern] = true
+		}
+	}
+}
+
+// matchMethod reports whether serviceMethod is matched by one of the
+// patterns, which are "Service.Method" or "Service.*".
+func matchMethod(patterns map[string]bool, serviceMethod string) bool {
+	if patterns[serviceMethod] {
+		return true
+	}
+	dot := strings.LastIndex(serviceMethod, ".")
+	return dot >= 0 && patterns[serviceMethod[:dot]+".*"]
+}
+
+// hedgedCall serves the methods of WithHedging.
+func (xc *XClient) hedgedCall(ctx context.Context, serviceMethod string, args, ret interface{}) error {
+	window := xc.latencyWindow(serviceMethod)
+	delay := xc.hedge.Delay
+	if delay <= 0 {
+		delay = defaultBackupLatency
+	}
+	if xc.hedge.Percentile > 0 {
+		if d, ok := window.percentile(xc.hedge.Percentile); ok {
+			delay = d
+		}
+	}
+	copies := xc.hedge.MaxHedges
+	if copies <= 0 {
+		copies = 1
+	}
+
+	return xc.race(ctx, serviceMethod, args, ret, delay, copies+1, window.add)
+}
+
+// acquireHedge takes one of the HedgePolicy.MaxOutstanding hedges.
+func (xc *XClient) acquireHedge() bool {
+	max := int32(xc.hedge.MaxOutstanding)
+	if atomic.AddInt32(&xc.outstanding, 1) > max && max > 0 {
+		atomic.AddInt32(&xc.outstanding, -1)
+		return false
+	}
+	return true
+}
+
+func (xc *XClient) releaseHedge() {
+	atomic.AddInt32(&xc.outstanding, -1)
+}
+
+func (xc *XClient) latencyWindow(serviceMethod string) *latencyWindow {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	w := xc.latencies[serviceMethod]
+	if w == nil {
+		w = new(latencyWindow)
+		xc.latencies[serviceMethod] = w
+	}
+	return w
+}
+
+// latencyWindow keeps the latencies of the recent calls of a method.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	n       int // samples added so far
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.n%latencySamples] = d
+	w.n++
+}
+
+// percentile returns the p-th percentile, 0 < p <= 1, of the samples,
+// false if there are too few of them.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	n := w.n
+	if n > latencySamples {
+		n = latencySamples
+	}
+	if n < minLatencySamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p*float64(n)+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return sorted[i], true
+}
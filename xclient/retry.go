@@ -0,0 +1,176 @@
+package xclient
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	. "github.com/devhg/drpc"
+)
+
+// 重试只针对幂等的方法：请求可能已经在服务端执行过，非幂等的方法重试会重复执行。
+// 唯一的例外是连接失败，此时请求还没有发出，任何方法都可以安全地重试。
+// 每次重试都会尽量换一个没有试过的服务。
+
+const (
+	defaultInitialBackoff = 50 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+	defaultMultiplier     = 2
+	defaultJitter         = 0.2
+)
+
+// RetryPolicy tells XClient.Call how to retry failed calls, see WithRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one.
+	// 1 or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, 50ms if 0. Each retry
+	// waits Multiplier (2 if 0) times longer than the previous one, up to
+	// MaxBackoff (1s if 0).
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes each wait by up to ±Jitter of it, so that clients that
+	// failed together do not retry together. 0.2 if 0, negative disables it.
+	Jitter float64
+	// RetryableCodes are the codes worth another attempt, Unavailable if empty.
+	RetryableCodes []Code
+	// PerAttemptTimeout bounds each attempt, 0 means that the attempts share
+	// the deadline of the call. An attempt that runs out of it is retried.
+	PerAttemptTimeout time.Duration
+}
+
+// XClientOption configures an XClient, see NewXClient.
+type XClientOption func(*XClient)
+
+// WithRetryPolicy makes Call retry the idempotent methods, see WithIdempotent,
+// as told by p. It applies to the default, Failover and Failtry modes. Without
+// it, Call makes a single attempt in the default mode, and Failover and Failtry
+// only retry the calls that were never sent.
+func WithRetryPolicy(p RetryPolicy) XClientOption {
+	return func(xc *XClient) {
+		xc.retry = p
+	}
+}
+
+// WithIdempotent marks the methods matched by the patterns as idempotent,
+// i.e. safe to call again after an attempt that may have reached the server.
+// A pattern is "Service.Method" or "Service.*".
+func WithIdempotent(patterns ...string) XClientOption {
+	return func(xc *XClient) {
+		for _, p := range patterns {
+			xc.idempotent[p] = true
+		}
+	}
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// retryable reports whether an attempt that failed with err is worth another.
+// sent is false if the call never left the client.
+func (p *RetryPolicy) retryable(err error, sent, idempotent, attemptTimedOut bool) bool {
+	if !sent {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	if attemptTimedOut {
+		return true
+	}
+	code := CodeOf(err)
+	if len(p.RetryableCodes) == 0 {
+		return code == Unavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before retry n, counting from 0.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d, max, mult, jitter := p.InitialBackoff, p.MaxBackoff, p.Multiplier, p.Jitter
+	if d <= 0 {
+		d = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	if mult <= 0 {
+		mult = defaultMultiplier
+	}
+	if jitter == 0 {
+		jitter = defaultJitter
+	}
+
+	wait := float64(d)
+	for i := 0; i < n && wait < float64(max); i++ {
+		wait *= mult
+	}
+	if wait > float64(max) {
+		wait = float64(max)
+	}
+	if jitter > 0 {
+		wait *= 1 + jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(wait)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pick chooses a server with Discovery.Get, avoiding the servers in tried
+// as long as there are others, and never choosing a server whose circuit
+// is open.
+func (xc *XClient) pick(tried map[string]bool) (string, error) {
+	rpcAddr, err := xc.d.Get(xc.mode)
+	if err != nil {
+		return "", err
+	}
+	selectable := xc.breakers.get(rpcAddr).selectable()
+	if selectable && !tried[rpcAddr] {
+		return rpcAddr, nil
+	}
+
+	// Get 选中了已经试过或者熔断的服务，从剩下的服务中随机选一个
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	var untried, closed []string
+	for _, s := range servers {
+		if !xc.breakers.get(s).selectable() {
+			continue
+		}
+		closed = append(closed, s)
+		if !tried[s] {
+			untried = append(untried, s)
+		}
+	}
+	switch {
+	case len(untried) > 0:
+		return untried[rand.Intn(len(untried))], nil
+	case selectable:
+		return rpcAddr, nil
+	case len(closed) > 0:
+		return closed[rand.Intn(len(closed))], nil
+	}
+	return "", Errorf(Unavailable, "rpc xclient: the circuits of all servers are open")
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"time"
 
 	. "github.com/devhg/drpc"
 )
@@ -16,6 +17,20 @@ type XClient struct {
 	opt     *Option
 	mu      sync.Mutex
 	clients map[string]*Client
+
+	interceptors []ClientInterceptor
+
+	retry         RetryPolicy
+	idempotent    map[string]bool // patterns of WithIdempotent
+	failMode      FailMode
+	backupLatency time.Duration
+
+	hedge       HedgePolicy
+	hedged      map[string]bool           // patterns of WithHedging
+	latencies   map[string]*latencyWindow // serviceMethod -> recent latencies
+	outstanding int32                     // hedges in flight
+
+	breakers *breakerSet // nil without WithCircuitBreaker
 }
 
 var _ io.Closer = (*XClient)(nil)
@@ -24,15 +39,37 @@ var _ io.Closer = (*XClient)(nil)
 // * 服务发现实例 Discovery
 // * 负载均衡模式 SelectMode
 // * 协议选项 Option
+// 以及可选的 XClientOption，例如失败模式 WithFailMode 和重试策略 WithRetryPolicy。
 // 为了尽量地复用已经创建好的 Socket 连接，使用 clients 保存创建成功的 Client 实例，
 // 并提供 Close 方法。用于在结束后，关闭已经建立的所有连接
-func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{
-		d:       d,
-		mode:    mode,
-		opt:     opt,
-		clients: make(map[string]*Client),
+func NewXClient(d Discovery, mode SelectMode, opt *Option, opts ...XClientOption) *XClient {
+	xc := &XClient{
+		d:          d,
+		mode:       mode,
+		opt:        opt,
+		clients:    make(map[string]*Client),
+		idempotent: make(map[string]bool),
+		hedged:     make(map[string]bool),
+		latencies:  make(map[string]*latencyWindow),
+	}
+	for _, o := range opts {
+		o(xc)
+	}
+	if d, ok := d.(interface{ SetLoadReporter(LoadReporter) }); ok {
+		d.SetLoadReporter(xc)
+	}
+	return xc
+}
+
+// ActiveRequests returns the calls in flight to rpcAddr, see LoadReporter.
+func (xc *XClient) ActiveRequests(rpcAddr string) int {
+	xc.mu.Lock()
+	client := xc.clients[rpcAddr]
+	xc.mu.Unlock()
+	if client == nil {
+		return 0
 	}
+	return client.ActiveRequests()
 }
 
 func (xc *XClient) Close() error {
@@ -45,53 +82,165 @@ func (xc *XClient) Close() error {
 	return nil
 }
 
+// Use appends interceptors to the chain wrapping Call and BroadCast.
+// They run once per XClient call, before a server is chosen.
+func (xc *XClient) Use(interceptors ...ClientInterceptor) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.interceptors = append(xc.interceptors, interceptors...)
+}
+
+func (xc *XClient) chain(invoker Invoker) Invoker {
+	xc.mu.Lock()
+	interceptors := xc.interceptors
+	xc.mu.Unlock()
+	return ChainClientInterceptors(invoker, interceptors...)
+}
+
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
 // xc will choose a proper server.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, ret interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
-	if err != nil {
-		return err
+	return xc.chain(xc.selectCall)(ctx, serviceMethod, args, ret)
+}
+
+// selectCall makes the attempts of a call, see FailMode and RetryPolicy.
+func (xc *XClient) selectCall(ctx context.Context, serviceMethod string, args, ret interface{}) error {
+	if matchMethod(xc.hedged, serviceMethod) {
+		return xc.hedgedCall(ctx, serviceMethod, args, ret)
+	}
+	if xc.failMode == Failbackup {
+		return xc.backupCall(ctx, serviceMethod, args, ret)
+	}
+	maxAttempts := xc.retry.maxAttempts()
+	// 没有 RetryPolicy 时，Failover 和 Failtry 只重试没有发出的请求
+	unsentOnly := false
+	switch xc.failMode {
+	case Failfast:
+		maxAttempts = 1
+	case Failover, Failtry:
+		if xc.retry.MaxAttempts == 0 {
+			maxAttempts, unsentOnly = defaultFailAttempts, true
+		}
 	}
-	return xc.call(ctx, rpcAddr, serviceMethod, args, ret)
+
+	idempotent := matchMethod(xc.idempotent, serviceMethod)
+	tried := make(map[string]bool)
+	var rpcAddr string
+	for n := 0; ; n++ {
+		if n == 0 || xc.failMode != Failtry {
+			var err error
+			if rpcAddr, err = xc.pick(tried); err != nil {
+				return err
+			}
+			tried[rpcAddr] = true
+		}
+
+		sent, timedOut, err := xc.attempt(ctx, rpcAddr, serviceMethod, args, ret)
+		if err == nil || n+1 >= maxAttempts || ctx.Err() != nil || (sent && unsentOnly) ||
+			!xc.retry.retryable(err, sent, idempotent, timedOut) {
+			return err
+		}
+		if sleep(ctx, xc.retry.backoff(n)) != nil {
+			return err
+		}
+	}
+}
+
+// attempt makes one attempt of a call on rpcAddr. sent is false if the call
+// never left the client, timedOut is true if the attempt ran out of
+// RetryPolicy.PerAttemptTimeout.
+func (xc *XClient) attempt(ctx context.Context,
+	rpcAddr, serviceMethod string, args, ret interface{}) (sent, timedOut bool, err error) {
+	if d := xc.retry.PerAttemptTimeout; d > 0 {
+		attemptCtx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		sent, err = xc.send(attemptCtx, rpcAddr, serviceMethod, args, ret)
+		return sent, attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil, err
+	}
+	sent, err = xc.send(ctx, rpcAddr, serviceMethod, args, ret)
+	return sent, false, err
 }
 
 func (xc *XClient) call(ctx context.Context,
 	rpcAddr, serviceMethod string, args, ret interface{}) error {
+	_, err := xc.send(ctx, rpcAddr, serviceMethod, args, ret)
+	return err
+}
+
+// send calls rpcAddr through its circuit breaker, see WithCircuitBreaker.
+// sent is false if the call never left the client.
+func (xc *XClient) send(ctx context.Context,
+	rpcAddr, serviceMethod string, args, ret interface{}) (sent bool, err error) {
+	b := xc.breakers.get(rpcAddr)
+	if err := b.allow(); err != nil {
+		return false, err
+	}
+	sent, err = xc.dialCall(ctx, rpcAddr, serviceMethod, args, ret)
+	// 调用方取消的请求（包括对冲中落败的请求）不能说明服务端的状况
+	b.done(err, sent && ctx.Err() == context.Canceled)
+	return sent, err
+}
+
+// dialCall calls rpcAddr, bypassing its circuit breaker.
+// sent is false if the call never left the client.
+func (xc *XClient) dialCall(ctx context.Context,
+	rpcAddr, serviceMethod string, args, ret interface{}) (sent bool, err error) {
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return client.Call(ctx, serviceMethod, args, ret)
+	return true, client.Call(ctx, serviceMethod, args, ret)
 }
 
 // 实现 client 的复用能力
+// 建立连接时不持有 xc.mu，一个连接缓慢或者已经宕机的服务不会阻塞其他服务的请求
 func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-
 	// 先查缓存
 	client, ok := xc.clients[rpcAddr]
 	if ok && !client.IsAvailable() {
-		_ = client.Close()
+		// 服务端正在关闭时，client 上可能还有未完成的请求，由服务端在处理完后关闭连接
+		if !client.GoingAway() {
+			_ = client.Close()
+		}
 		delete(xc.clients, rpcAddr)
 		client = nil
 	}
+	xc.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
 
 	// 创建新的客户端
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
+	client, err := XDial(rpcAddr, xc.opt)
+	if err != nil {
+		if CodeOf(err) == Unknown {
+			err = Errorf(Unavailable, "rpc xclient: dial %s: %v", rpcAddr, err)
 		}
-		xc.clients[rpcAddr] = client
+		return nil, err
 	}
+
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if cached, ok := xc.clients[rpcAddr]; ok && cached.IsAvailable() {
+		// 同时建立了两个连接，保留先建立的那个
+		_ = client.Close()
+		return cached, nil
+	}
+	xc.clients[rpcAddr] = client
 	return client, nil
 }
 
-// BroadCast invokes the named function for every server registered in discovery
+// BroadCast invokes the named function for every server registered in discovery.
+// It reaches every server, so it bypasses the circuit breakers: an open circuit
+// neither skips its server nor fails the broadcast, and the results of the
+// broadcast are not counted by the breakers.
 func (xc *XClient) BroadCast(ctx context.Context, serviceMethod string, args, ret interface{}) error {
+	return xc.chain(xc.broadCast)(ctx, serviceMethod, args, ret)
+}
+
+func (xc *XClient) broadCast(ctx context.Context, serviceMethod string, args, ret interface{}) error {
 	servers, err := xc.d.GetAll()
 	if err != nil {
 		return err
@@ -114,7 +263,7 @@ func (xc *XClient) BroadCast(ctx context.Context, serviceMethod string, args, re
 				clonedReply = reflect.New(reflect.ValueOf(ret).Elem().Type()).Interface()
 			}
 
-			err := xc.call(ctx, rpcAddr, serviceMethod, args, clonedReply)
+			_, err := xc.dialCall(ctx, rpcAddr, serviceMethod, args, clonedReply)
 			mu.Lock()
 			if err != nil && e == nil {
 				e = err
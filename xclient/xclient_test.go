@@ -0,0 +1,500 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/devhg/drpc"
+	"github.com/devhg/drpc/registry"
+)
+
+func assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// Backend answers with its name, or fails with fail if it is not OK.
+type Backend struct {
+	name      string
+	fail      Code
+	failFirst int32 // fails the first calls with Unavailable
+	delay     time.Duration
+	calls     int32
+}
+
+func (b *Backend) Name(ctx context.Context, _ int, reply *string) error {
+	if atomic.AddInt32(&b.calls, 1) <= b.failFirst {
+		return Errorf(Unavailable, "%s is warming up", b.name)
+	}
+	if b.delay > 0 {
+		select {
+		case <-time.After(b.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if b.fail != OK {
+		return Errorf(b.fail, "%s failed", b.name)
+	}
+	*reply = b.name
+	return nil
+}
+
+func (b *Backend) Calls() int {
+	return int(atomic.LoadInt32(&b.calls))
+}
+
+// startBackend serves b and returns its address for XDial.
+func startBackend(t *testing.T, b *Backend) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	server := NewServer()
+	assert(server.Register(b) == nil, "register error")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Close() })
+	return "tcp@" + l.Addr().String()
+}
+
+// deadAddr returns an address nobody listens on.
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	_ = l.Close()
+	return "tcp@" + l.Addr().String()
+}
+
+func TestXClient_Retry(t *testing.T) {
+	bad := &Backend{name: "bad", fail: Unavailable}
+	good := &Backend{name: "good"}
+	servers := []string{startBackend(t, bad), startBackend(t, good)}
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+
+	// 幂等的方法换一个服务重试
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil,
+		WithRetryPolicy(policy), WithIdempotent("Backend.*"))
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 4; i++ {
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "good", "expect the retry to reach good, got %q: %v", name, err)
+	}
+	assert(good.Calls() == 4, "expect every call to reach good once, got %d", good.Calls())
+
+	// 非幂等的方法不会重试
+	xc = NewXClient(NewMultiServerDiscovery(servers[:1]), RoundRobinSelect, nil, WithRetryPolicy(policy))
+	defer func() { _ = xc.Close() }()
+	calls := bad.Calls()
+	err := xc.Call(context.Background(), "Backend.Name", 0, new(string))
+	assert(CodeOf(err) == Unavailable && bad.Calls() == calls+1, "expect a single attempt, got %v", err)
+
+	// 连接失败时请求没有发出，非幂等的方法也可以重试
+	xc = NewXClient(NewMultiServerDiscovery([]string{deadAddr(t), servers[1]}), RoundRobinSelect, nil,
+		WithRetryPolicy(policy))
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 2; i++ {
+		var name string
+		err = xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "good", "expect the dial failure to be retried, got %q: %v", name, err)
+	}
+}
+
+func TestXClient_PerAttemptTimeout(t *testing.T) {
+	slow := &Backend{name: "slow", delay: time.Second}
+	fast := &Backend{name: "fast"}
+	servers := []string{startBackend(t, slow), startBackend(t, fast)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, PerAttemptTimeout: 50 * time.Millisecond}),
+		WithIdempotent("Backend.Name"))
+	defer func() { _ = xc.Close() }()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "fast", "expect the slow attempt to be retried, got %q: %v", name, err)
+	}
+	assert(time.Since(start) < time.Second, "expect the slow attempt to be cut short")
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Jitter: -1}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for n, w := range want {
+		got := p.backoff(n)
+		assert(got == w*time.Millisecond, "retry %d: expect %v, got %v", n, w*time.Millisecond, got)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := p.backoff(0)
+		assert(got >= 5*time.Millisecond && got <= 15*time.Millisecond, "expect jitter within 50%%, got %v", got)
+	}
+}
+
+func TestXClient_FailMode(t *testing.T) {
+	good := &Backend{name: "good"}
+	servers := []string{deadAddr(t), startBackend(t, good)}
+
+	// Failfast 不重试，连接失败的请求也直接返回；没有 RetryPolicy 时默认模式同样不重试
+	for _, opts := range [][]XClientOption{{WithFailMode(Failfast)}, nil} {
+		xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil, opts...)
+		var failed int
+		for i := 0; i < 2; i++ {
+			if err := xc.Call(context.Background(), "Backend.Name", 0, new(string)); err != nil {
+				assert(CodeOf(err) == Unavailable, "expect Unavailable, got %v", err)
+				failed++
+			}
+		}
+		_ = xc.Close()
+		assert(failed == 1, "expect the call to the dead server to fail, %d failed", failed)
+	}
+
+	// 没有 RetryPolicy 时，Failover 仍然把没有发出的请求交给下一个服务，Failtry 留在原来的服务
+	for _, mode := range []FailMode{Failover, Failtry} {
+		xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil, WithFailMode(mode))
+		var failed int
+		for i := 0; i < 2; i++ {
+			if err := xc.Call(context.Background(), "Backend.Name", 0, new(string)); err != nil {
+				assert(CodeOf(err) == Unavailable, "mode %d: expect Unavailable, got %v", mode, err)
+				failed++
+			}
+		}
+		_ = xc.Close()
+		if mode == Failover {
+			assert(failed == 0, "expect Failover to retry the unsent call, %d failed", failed)
+		} else {
+			assert(failed == 1, "expect Failtry to retry on the dead server only, %d failed", failed)
+		}
+	}
+	// 发出之后失败的请求没有 RetryPolicy 时不重试
+	flaky := &Backend{name: "flaky", failFirst: 1}
+	xc := NewXClient(NewMultiServerDiscovery([]string{startBackend(t, flaky)}), RoundRobinSelect, nil,
+		WithFailMode(Failover), WithIdempotent("Backend.*"))
+	err := xc.Call(context.Background(), "Backend.Name", 0, new(string))
+	_ = xc.Close()
+	assert(err != nil && flaky.Calls() == 1, "expect a sent call not to be retried, got %d calls: %v", flaky.Calls(), err)
+
+	// Failover 换一个服务重试，Failtry 留在原来的服务
+	for _, mode := range []FailMode{Failover, Failtry} {
+		a := &Backend{name: "a", failFirst: 1}
+		b := &Backend{name: "b", failFirst: 1}
+		xc := NewXClient(NewMultiServerDiscovery([]string{startBackend(t, a), startBackend(t, b)}), RandomSelect, nil,
+			WithFailMode(mode), WithIdempotent("Backend.*"),
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		_ = xc.Close()
+		assert(err == nil, "mode %d: expect the retry to succeed, got %v", mode, err)
+		if mode == Failover {
+			assert(a.Calls() >= 1 && b.Calls() >= 1, "expect Failover to try both servers")
+		} else {
+			assert(a.Calls()+b.Calls() == 2 && (a.Calls() == 0 || b.Calls() == 0),
+				"expect Failtry to stay on one server, got %d and %d calls", a.Calls(), b.Calls())
+		}
+	}
+}
+
+func TestXClient_Failbackup(t *testing.T) {
+	slow := &Backend{name: "slow", delay: time.Second}
+	fast := &Backend{name: "fast"}
+	servers := []string{startBackend(t, slow), startBackend(t, fast)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil,
+		WithFailMode(Failbackup), WithBackupLatency(20*time.Millisecond))
+	defer func() { _ = xc.Close() }()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "fast", "expect the backup reply, got %q: %v", name, err)
+	}
+	assert(time.Since(start) < time.Second, "expect the slow server not to be waited for")
+}
+
+func TestXClient_Hedging(t *testing.T) {
+	slow := &Backend{name: "slow", delay: time.Second}
+	fast := &Backend{name: "fast"}
+	servers := []string{startBackend(t, slow), startBackend(t, fast)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil,
+		WithHedging(HedgePolicy{Delay: 20 * time.Millisecond, Percentile: 0.9}, "Backend.Name"))
+	defer func() { _ = xc.Close() }()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "fast", "expect the hedged reply, got %q: %v", name, err)
+	}
+	assert(time.Since(start) < time.Second, "expect the slow server not to be waited for")
+	// 被取消的请求返回后归还对冲的名额
+	for i := 0; i < 100 && atomic.LoadInt32(&xc.outstanding) != 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert(atomic.LoadInt32(&xc.outstanding) == 0, "expect the hedges to be released")
+
+	// 对冲的上限
+	xc.hedge.MaxOutstanding = 1
+	assert(xc.acquireHedge() && !xc.acquireHedge(), "expect the second hedge to be refused")
+	xc.releaseHedge()
+	assert(xc.acquireHedge(), "expect a released hedge to be reusable")
+	xc.releaseHedge()
+}
+
+func TestXClient_HedgingLatencies(t *testing.T) {
+	bad := &Backend{name: "bad", fail: Unavailable}
+	good := &Backend{name: "good"}
+	servers := []string{startBackend(t, bad), startBackend(t, good)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil,
+		WithHedging(HedgePolicy{Delay: time.Second, Percentile: 0.9}, "Backend.Name"))
+	defer func() { _ = xc.Close() }()
+
+	for i := 0; i < 4; i++ {
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "good", "expect the hedge to reach good, got %q: %v", name, err)
+	}
+	// 只记录第一份请求的延迟，第一份请求失败时对冲请求的延迟不计入
+	w := xc.latencyWindow("Backend.Name")
+	assert(w.n == 4-bad.Calls(), "expect the latencies of the calls first sent to good only, got %d of them", w.n)
+
+	for p, want := range map[float64]float64{5: 1, -1: 0, 0.5: 0.5} {
+		xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil,
+			WithHedging(HedgePolicy{Percentile: p}))
+		assert(xc.hedge.Percentile == want, "expect percentile %v to become %v, got %v", p, want, xc.hedge.Percentile)
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	var w latencyWindow
+	_, ok := w.percentile(0.5)
+	assert(!ok, "expect too few samples")
+	for i := 1; i <= 100; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	d, ok := w.percentile(0.95)
+	assert(ok && d == 95*time.Millisecond, "expect p95 of 95ms, got %v", d)
+
+	// 旧的样本被新的覆盖
+	for i := 0; i < latencySamples; i++ {
+		w.add(time.Second)
+	}
+	d, _ = w.percentile(0.5)
+	assert(d == time.Second, "expect old samples to be dropped, got %v", d)
+}
+
+func TestXClient_CircuitBreaker(t *testing.T) {
+	bad := &Backend{name: "bad", failFirst: 2}
+	good := &Backend{name: "good"}
+	badAddr := startBackend(t, bad)
+	servers := []string{badAddr, startBackend(t, good)}
+	changes := make(chan BreakerState, 8)
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil, WithFailMode(Failfast),
+		WithCircuitBreaker(BreakerPolicy{
+			ConsecutiveFailures: 2,
+			OpenTimeout:         100 * time.Millisecond,
+			OnStateChange: func(rpcAddr string, _, to BreakerState) {
+				if rpcAddr == badAddr {
+					changes <- to
+				}
+			},
+		}))
+	defer func() { _ = xc.Close() }()
+
+	// bad 连续失败两次后熔断，之后的请求都发给 good
+	var failed int
+	for i := 0; i < 8; i++ {
+		if err := xc.Call(context.Background(), "Backend.Name", 0, new(string)); err != nil {
+			failed++
+		}
+	}
+	assert(failed == 2 && bad.Calls() == 2, "expect bad to be skipped once open, %d failed", failed)
+	assert(xc.Breakers()[badAddr].State == BreakerOpen, "expect the circuit of bad to be open")
+	assert(<-changes == BreakerOpen, "expect a state change to open")
+
+	// OpenTimeout 之后试探请求成功，熔断器关闭
+	time.Sleep(120 * time.Millisecond)
+	for i := 0; i < 10 && bad.Calls() < 3; i++ {
+		err := xc.Call(context.Background(), "Backend.Name", 0, new(string))
+		assert(err == nil, "expect the calls to succeed, got %v", err)
+	}
+	assert(xc.Breakers()[badAddr].State == BreakerClosed, "expect the circuit of bad to be closed")
+	assert(<-changes == BreakerHalfOpen && <-changes == BreakerClosed, "expect half-open then closed")
+}
+
+func TestXClient_BroadCastOpenCircuit(t *testing.T) {
+	a, b := &Backend{name: "a"}, &Backend{name: "b"}
+	aAddr := startBackend(t, a)
+	xc := NewXClient(NewMultiServerDiscovery([]string{aAddr, startBackend(t, b)}), RoundRobinSelect, nil,
+		WithCircuitBreaker(BreakerPolicy{OpenTimeout: time.Minute}))
+	defer func() { _ = xc.Close() }()
+	breaker := xc.breakers.get(aAddr)
+	breaker.mu.Lock()
+	breaker.setState(BreakerOpen)
+	breaker.mu.Unlock()
+
+	// BroadCast 绕过熔断器，仍然发给每个服务
+	err := xc.BroadCast(context.Background(), "Backend.Name", 0, new(string))
+	assert(err == nil, "expect the broadcast to succeed, got %v", err)
+	assert(a.Calls() == 1 && b.Calls() == 1, "expect every server to be called, got %d and %d", a.Calls(), b.Calls())
+	assert(xc.Breakers()[aAddr].State == BreakerOpen, "expect the broadcast not to count")
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	var xc XClient
+	WithCircuitBreaker(BreakerPolicy{ConsecutiveFailures: 100, MinRequests: 4, ErrorRate: 0.5})(&xc)
+	b := xc.breakers.get("addr")
+	for i, err := range []error{nil, Errorf(Unavailable, "down"), Errorf(NotFound, "no such thing"), nil} {
+		assert(b.allow() == nil, "call %d: expect the circuit to be closed", i)
+		b.done(err, false)
+	}
+	assert(b.stats().State == BreakerClosed, "expect business errors not to count")
+
+	assert(b.allow() == nil, "expect the circuit to be closed")
+	b.done(Errorf(DeadlineExceeded, "slow"), false)
+	assert(b.allow() == nil, "expect the circuit to be closed")
+	b.done(Errorf(Internal, "panic"), false)
+	assert(b.stats().State == BreakerOpen, "expect 3 failures out of 6 calls to open the circuit")
+	assert(CodeOf(b.allow()) == Unavailable, "expect an open circuit to refuse calls")
+}
+
+func TestBreaker_HalfOpenSelectable(t *testing.T) {
+	var xc XClient
+	WithCircuitBreaker(BreakerPolicy{OpenTimeout: time.Millisecond, HalfOpenRequests: 1})(&xc)
+	b := xc.breakers.get("addr")
+	b.mu.Lock()
+	b.setState(BreakerOpen)
+	b.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+
+	assert(b.selectable() && b.allow() == nil, "expect a trial call after OpenTimeout")
+	assert(b.stats().State == BreakerHalfOpen, "expect the circuit to be half-open")
+	assert(!b.selectable(), "expect no more picks while the trial call is in flight")
+	b.done(nil, false)
+	assert(b.selectable(), "expect the circuit to be selectable once closed")
+}
+
+func TestBalancers(t *testing.T) {
+	candidates := []Candidate{{Addr: "a", Weight: 5}, {Addr: "b", Weight: 1}, {Addr: "c", Weight: 1}}
+
+	// 平滑加权轮询：按权重分配，并且权重大的服务不会被连续选中太多次
+	wrr := NewWeightedRoundRobinBalancer()
+	var picks []string
+	for i := 0; i < 7; i++ {
+		picks = append(picks, wrr.Pick(candidates))
+	}
+	assert(strings.Join(picks, "") == "aabacaa", "expect smooth weighted picks, got %v", picks)
+
+	candidates[0].Active, candidates[1].Active, candidates[2].Active = 3, 0, 5
+	for i := 0; i < 10; i++ {
+		addr := NewLeastActiveBalancer().Pick(candidates)
+		assert(addr == "b", "expect the least active server, got %s", addr)
+		addr = NewPowerOfTwoBalancer().Pick(candidates)
+		assert(addr != "c", "expect the busiest server never to win a pair, got %s", addr)
+	}
+
+	d := NewMultiServerDiscovery([]string{"a", "b"})
+	d.SetWeights(map[string]int{"a": 3})
+	count := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		addr, err := d.Get(WeightedRoundRobinSelect)
+		assert(err == nil, "get error: %v", err)
+		count[addr]++
+	}
+	assert(count["a"] == 6 && count["b"] == 2, "expect picks in proportion to the weights, got %v", count)
+	_, err := d.Get(SelectMode(100))
+	assert(err != nil, "expect an unsupported mode to fail")
+}
+
+func TestXClient_LeastActive(t *testing.T) {
+	busy := &Backend{name: "busy", delay: 300 * time.Millisecond}
+	idle := &Backend{name: "idle"}
+	busyAddr := startBackend(t, busy)
+	xc := NewXClient(NewMultiServerDiscovery([]string{busyAddr, startBackend(t, idle)}), LeastActiveSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	go func() { _ = xc.call(context.Background(), busyAddr, "Backend.Name", 0, new(string)) }()
+	for i := 0; i < 100 && xc.ActiveRequests(busyAddr) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert(xc.ActiveRequests(busyAddr) == 1, "expect a call in flight to busy")
+	for i := 0; i < 5; i++ {
+		var name string
+		err := xc.Call(context.Background(), "Backend.Name", 0, &name)
+		assert(err == nil && name == "idle", "expect the idle server, got %q: %v", name, err)
+	}
+}
+
+// countingReporter counts the lookups of the load.
+type countingReporter int32
+
+func (r *countingReporter) ActiveRequests(string) int {
+	atomic.AddInt32((*int32)(r), 1)
+	return 0
+}
+
+func TestXClient_SlowDial(t *testing.T) {
+	// stuck 接受连接但不回应握手
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(err == nil, "listen error: %v", err)
+	defer func() { _ = l.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	stuckAddr, goodAddr := "tcp@"+l.Addr().String(), startBackend(t, &Backend{name: "good"})
+	xc := NewXClient(NewMultiServerDiscovery([]string{stuckAddr, goodAddr}), LeastActiveSelect,
+		&Option{ConnectTimeout: 2 * time.Second})
+	defer func() { _ = xc.Close() }()
+
+	go func() { _ = xc.call(context.Background(), stuckAddr, "Backend.Name", 0, new(string)) }()
+	conn := <-accepted
+	defer func() { _ = conn.Close() }()
+
+	// 连接 stuck 的过程中，选择服务和调用其他服务都不受影响
+	start := time.Now()
+	_, err = xc.d.Get(LeastActiveSelect)
+	assert(err == nil, "get error: %v", err)
+	var name string
+	err = xc.call(context.Background(), goodAddr, "Backend.Name", 0, &name)
+	assert(err == nil && name == "good", "expect good to answer, got %q: %v", name, err)
+	assert(time.Since(start) < time.Second, "expect the dial of stuck not to block, took %v", time.Since(start))
+}
+
+func TestMultiServerDiscovery_Load(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b"})
+	var lookups countingReporter
+	d.SetLoadReporter(&lookups)
+	for _, mode := range []SelectMode{RandomSelect, RoundRobinSelect, WeightedRoundRobinSelect} {
+		_, _ = d.Get(mode)
+	}
+	assert(lookups == 0, "expect no load lookups for balancers that ignore the load, got %d", lookups)
+	_, _ = d.Get(LeastActiveSelect)
+	assert(lookups == 2, "expect a load lookup per server, got %d", lookups)
+}
+
+func TestRegistryWeights(t *testing.T) {
+	reg := httptest.NewServer(registry.New(0))
+	defer reg.Close()
+	stop := registry.HeartbeatWeighted(reg.URL, "tcp@heavy", 4, 0)
+	defer stop()
+	stop = registry.Heartbeat(reg.URL, "tcp@light", 0)
+	defer stop()
+
+	d := NewDrpcRegistryDiscovery(reg.URL, 0)
+	count := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		addr, err := d.Get(WeightedRoundRobinSelect)
+		assert(err == nil, "get error: %v", err)
+		count[addr]++
+	}
+	assert(count["tcp@heavy"] == 8 && count["tcp@light"] == 2, "expect the registry weights, got %v", count)
+}